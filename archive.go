@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// serveArchive packs a directory into a tar.gz as it's sent, for
+// -compress-dir. Everything goes under the directory's own name, the way tar
+// would do it, so it unpacks into a folder rather than all over the place.
+//
+// There's no size up front and no ranges, so a download can't be resumed. If
+// something goes wrong partway, the archive's left without its ending, so the
+// other end can tell it's broken.
+func serveArchive(w http.ResponseWriter, r *http.Request, dir string) error {
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	top := filepath.Base(filepath.Clean(dir))
+	err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch {
+		case info.Mode().IsRegular(), info.IsDir():
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err = os.Readlink(name)
+			if err != nil {
+				return err
+			}
+		default:
+			// Sockets, devices, and the like don't travel.
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(top, filepath.ToSlash(rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = tw.WriteHeader(header)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not archive %v: %w", dir, err)
+	}
+
+	err = tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+// dirSize adds up the size of every file in a directory, to give some idea
+// of what's being sent before it's compressed.
+func dirSize(dir string) (files int, size int64, err error) {
+	err = filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		size += info.Size()
+		return nil
+	})
+	return files, size, err
+}
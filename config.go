@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// shorthands maps each shorthand flag to the long one it stands in for, so a
+// setting given either way on the command line beats the config file.
+var shorthands = map[string]string{
+	"c": "count",
+	"p": "port",
+	"q": "hide-qr",
+	"s": "quiet",
+	"u": "upload",
+	"m": "multiple",
+}
+
+// defaultConfigFile is where settings are read from if -config isn't given.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ruff", "config")
+}
+
+// applyConfigFile fills in flags from a config file, skipping any that were
+// given on the command line. Each line is a flag name and its value:
+//
+//	# comments are fine too
+//	port = 9000
+//	hide-qr = true
+//	accept = ".jpg,.png"
+//
+// A missing file is only an error if it was asked for with -config.
+func applyConfigFile(name string, required bool) error {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read config: %w", err)
+	}
+	defer f.Close()
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		if long, ok := shorthands[f.Name]; ok {
+			given[long] = true
+		}
+	})
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return fmt.Errorf("%v:%v: expected a setting like port = 9000", name, line)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+
+		if long, ok := shorthands[key]; ok {
+			key = long
+		}
+		if key == "config" || key == "version" || flag.Lookup(key) == nil {
+			return fmt.Errorf("%v:%v: unknown setting %q", name, line, key)
+		}
+		if given[key] {
+			continue
+		}
+
+		err := flag.Set(key, value)
+		if err != nil {
+			return fmt.Errorf("%v:%v: invalid value %q for %v: %v", name, line, value, key, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// connKey is the context key the connection behind a request is kept under.
+type connKey struct{}
+
+// saveConn stashes each connection in its requests' contexts so a transfer
+// can be cut off later. It's meant for http.Server.ConnContext.
+func saveConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// transfers keeps track of the connections with a request in progress.
+var transfers = struct {
+	sync.Mutex
+	conns map[*http.Request]net.Conn
+}{conns: make(map[*http.Request]net.Conn)}
+
+// trackTransfers wraps a handler so its requests can be aborted from the
+// terminal.
+func trackTransfers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := r.Context().Value(connKey{}).(net.Conn)
+		if ok {
+			transfers.Lock()
+			transfers.conns[r] = conn
+			transfers.Unlock()
+			defer func() {
+				transfers.Lock()
+				delete(transfers.conns, r)
+				transfers.Unlock()
+			}()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// abortTransfers cuts off every request in progress by closing its
+// connection, which stops a download or upload dead wherever it's up to. It
+// returns how many there were.
+func abortTransfers() int {
+	transfers.Lock()
+	defer transfers.Unlock()
+	n := len(transfers.conns)
+	for r, conn := range transfers.conns {
+		conn.Close()
+		delete(transfers.conns, r)
+	}
+	return n
+}
+
+// readCommands reads from the terminal for -wait and -controls until it's
+// told to stop, or stdin runs dry.
+func readCommands(server *http.Server, conf Config) {
+	// If stdin is closed or redirected from nowhere there's nothing coming,
+	// so carry on until something else stops us.
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		command := strings.TrimSpace(scanner.Text())
+		switch {
+		case !conf.Controls, command == "" && conf.Wait, command == "q":
+			fmt.Fprintln(output, "shutting down...")
+			shutdown(server, conf.Grace)
+			return
+		case command == "a":
+			n := abortTransfers()
+			fmt.Fprintf(output, "aborted %v transfer(s)\n", n)
+		default:
+			fmt.Fprintln(output, "type a to abort transfers in progress, or q to quit")
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedup spots uploads that are identical to a file that's already in the
+// upload directory, for -dedup.
+//
+// Every upload means walking the whole directory, but that's only a stat per
+// file. Files are only hashed if they're the same size as the upload, and
+// each one's hash is kept until it changes, so it's rare for a file to be
+// read more than once.
+type dedup struct {
+	mu     sync.Mutex
+	hashes map[string]hashed
+}
+
+// hashed is a file's hash, along with what it looked like when it was hashed.
+type hashed struct {
+	size int64
+	mod  time.Time
+	sum  string
+}
+
+func newDedup() *dedup {
+	return &dedup{hashes: make(map[string]hashed)}
+}
+
+// check looks for a file identical to a freshly saved upload. If there is
+// one, the upload is removed and saved.Duplicate says which file it was a
+// duplicate of.
+func (d *dedup) check(saved *savedFile) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	self := filepath.Clean(saved.Name)
+	var match string
+	err := filepath.WalkDir(".", func(name string, entry fs.DirEntry, err error) error {
+		// Anything we can't read can't be a duplicate either.
+		if err != nil || !entry.Type().IsRegular() || name == self || strings.HasSuffix(name, ".part") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() != saved.Size {
+			return nil
+		}
+
+		h, ok := d.hashes[name]
+		if !ok || h.size != info.Size() || !h.mod.Equal(info.ModTime()) {
+			sum, err := hashFile(name)
+			if err != nil {
+				return nil
+			}
+			h = hashed{info.Size(), info.ModTime(), sum}
+			d.hashes[name] = h
+		}
+		if h.sum == saved.SHA256 {
+			match = name
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if match == "" {
+		// We already know this one's hash, so save looking it up next time.
+		if info, err := os.Stat(self); err == nil {
+			d.hashes[self] = hashed{info.Size(), info.ModTime(), saved.SHA256}
+		}
+		return nil
+	}
+
+	err = os.Remove(self)
+	if err != nil {
+		return err
+	}
+	saved.Duplicate = match
+	logger.Info("upload was a duplicate", "name", saved.Name, "of", match)
+	return nil
+}
@@ -1,5 +1,23 @@
 module git.tilde.town/diff/ruff
 
-go 1.14
+go 1.21
 
-require github.com/mdp/qrterminal v1.0.1
+require (
+	github.com/atotto/clipboard v0.1.4
+	github.com/grandcat/zeroconf v1.0.0
+	github.com/huin/goupnp v1.3.0
+	github.com/mdp/qrterminal v1.0.1
+	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa
+	golang.org/x/term v0.15.0
+	golang.org/x/text v0.3.0
+	golang.org/x/time v0.5.0
+	rsc.io/qr v0.2.0
+)
+
+require (
+	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
+	github.com/miekg/dns v1.1.27 // indirect
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/sys v0.15.0 // indirect
+)
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// precompressed lists extensions of formats that are already compressed, so
+// gzipping them again would burn CPU for nothing.
+var precompressed = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".avif": true, ".br": true,
+	".bz2": true, ".docx": true, ".flac": true, ".gif": true, ".gz": true,
+	".heic": true, ".jar": true, ".jpeg": true, ".jpg": true, ".m4a": true,
+	".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".odt": true,
+	".ogg": true, ".opus": true, ".pdf": true, ".png": true, ".pptx": true,
+	".rar": true, ".tgz": true, ".webm": true, ".webp": true, ".xlsx": true,
+	".xz": true, ".zip": true, ".zst": true,
+}
+
+// compressible reports whether a file is worth gzipping, going by its name.
+func compressible(name string) bool {
+	return !precompressed[strings.ToLower(filepath.Ext(name))]
+}
+
+// acceptsGzip reports whether the client said it can take a gzipped response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(enc) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveGzip sends a file compressed on the fly. The compressed size isn't
+// known up front, so unlike http.ServeFile there's no Content-Length and no
+// ranges, just the whole thing streamed out.
+func serveGzip(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		http.Error(w, "could not open file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Left to itself the server would sniff the compressed bytes, which won't
+	// tell it much, so sniff the real ones.
+	if w.Header().Get("Content-Type") == "" {
+		buf := make([]byte, 512)
+		n, _ := io.ReadFull(f, buf)
+		w.Header().Set("Content-Type", http.DetectContentType(buf[:n]))
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			http.Error(w, "could not read file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	io.Copy(gz, f)
+}
+
+// badEncoding is what a compressed upload gives when it doesn't decompress,
+// because it was cut short or was never what it said it was.
+type badEncoding struct {
+	err error
+}
+
+func (e badEncoding) Error() string {
+	if errors.Is(e.err, io.ErrUnexpectedEOF) {
+		return "could not decompress upload, it was cut short"
+	}
+	return fmt.Sprintf("could not decompress upload: %v", e.err)
+}
+
+func (e badEncoding) Unwrap() error {
+	return e.err
+}
+
+// errEncoding is what decompressBody returns for a Content-Encoding it
+// doesn't know how to undo.
+var errEncoding = errors.New("uploads can only be compressed with gzip or deflate")
+
+// decompressBody swaps out the body of an upload sent with Content-Encoding
+// gzip or deflate for what it decompresses to, so the file's saved as it was
+// rather than as it went over the wire. Anything wrong with the compressed
+// stream comes out of the new body as a badEncoding, while trouble with the
+// connection itself, like going over -max-size, comes out as it always does.
+func decompressBody(r *http.Request) error {
+	enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if enc == "" || enc == "identity" {
+		return nil
+	}
+
+	body := &errReader{r: r.Body}
+	var dec io.Reader
+	var err error
+	switch enc {
+	case "gzip", "x-gzip":
+		dec, err = gzip.NewReader(body)
+	case "deflate":
+		// HTTP's deflate is the zlib format, not bare deflate.
+		dec, err = zlib.NewReader(body)
+	default:
+		return errEncoding
+	}
+	if err != nil {
+		return body.blame(err)
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{&decodedReader{dec, body}, r.Body}
+	r.Header.Del("Content-Encoding")
+	r.ContentLength = -1
+	return nil
+}
+
+// errReader remembers the last error reading from r, so a decompressor's
+// errors can be told apart from the connection's.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.err = err
+	return n, err
+}
+
+// blame passes err along as is if it came from the connection, and as a
+// badEncoding if it's down to what was sent.
+func (r *errReader) blame(err error) error {
+	if err == nil || err == io.EOF || r.err != nil && r.err != io.EOF {
+		return err
+	}
+	return badEncoding{err}
+}
+
+// decodedReader reads the decompressed body, blaming any errors on the right
+// party along the way.
+type decodedReader struct {
+	dec  io.Reader
+	body *errReader
+}
+
+func (r *decodedReader) Read(b []byte) (int, error) {
+	n, err := r.dec.Read(b)
+	return n, r.body.blame(err)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// h2cConns counts the requests going through serveH2C. An h2c connection is
+// hijacked out from under the http.Server and served from inside one of
+// those requests until it closes, so Shutdown doesn't wait for it, but
+// waitH2C can.
+var h2cConns sync.WaitGroup
+
+// serveH2C wraps a handler to speak HTTP/2 over plain HTTP to clients that
+// either upgrade to it or start out speaking it. Without TLS there's nothing
+// to negotiate HTTP/2 with, so that's the only way to get it. Everyone else
+// gets HTTP/1.1 as usual.
+func serveH2C(server *http.Server, next http.Handler) (http.Handler, error) {
+	h2s := &http2.Server{}
+	// This is what gets HTTP/2 connections sent a GOAWAY when the server
+	// shuts down, so they wrap up instead of hanging around.
+	err := http2.ConfigureServer(server, h2s)
+	if err != nil {
+		return nil, err
+	}
+	h := h2c.NewHandler(next, h2s)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h2cConns.Add(1)
+		defer h2cConns.Done()
+		h.ServeHTTP(w, r)
+	}), nil
+}
+
+// waitH2C waits for h2c connections to finish up after the server's been
+// shut down, or for ctx to run out.
+func waitH2C(ctx context.Context) {
+	finished := make(chan struct{})
+	go func() {
+		h2cConns.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// hyperlink makes link clickable for -hyperlink, in terminals that support
+// OSC 8 hyperlinks. The rest just show the link as usual. It's left alone
+// when w isn't a terminal, so the escapes don't end up in a pipe or a file.
+func hyperlink(w io.Writer, link string) string {
+	if !isTerminal(w) {
+		return link
+	}
+	return osc8(link)
+}
+
+// osc8 wraps link in the escapes that make it a hyperlink. The target gets
+// the same escaping a browser would give it, since spaces and the like would
+// cut it short.
+func osc8(link string) string {
+	target := link
+	if u, err := url.Parse(link); err == nil {
+		target = u.String()
+	}
+	return "\x1b]8;;" + target + "\x1b\\" + link + "\x1b]8;;\x1b\\"
+}
+
+// isTerminal reports whether w is a terminal rather than a pipe or a file,
+// going by the same check the QR code does.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// uploadResult is the JSON response to a successful upload.
+type uploadResult struct {
+	Saved []string    `json:"saved"`
+	Bytes int64       `json:"bytes"`
+	Files []savedFile `json:"files"`
+}
+
+// jsonError is the JSON response to anything that went wrong.
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+// fileMeta describes the file being offered for download.
+type fileMeta struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Type   string `json:"type,omitempty"`
+	SHA256 string `json:"sha256"`
+	// Remaining is how many downloads are left, or -1 if there's no limit.
+	Remaining int `json:"remaining"`
+}
+
+// writeJSON sends v to the client as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write JSON response: %v\n", err)
+	}
+}
+
+var (
+	checksumOnce sync.Once
+	checksum     string
+	checksumErr  error
+)
+
+// getFileMeta stats the offered file and hashes it. Hashing a big file takes
+// a while, so it's only done the first time somebody asks.
+func getFileMeta(conf Config) (fileMeta, error) {
+	meta := fileMeta{Name: conf.FileName, Type: fileType(conf)}
+
+	info, err := os.Stat(conf.FilePath)
+	if err != nil {
+		return meta, fmt.Errorf("could not stat %v: %w", conf.FilePath, err)
+	}
+	meta.Size = info.Size()
+
+	checksumOnce.Do(func() {
+		checksum, checksumErr = hashFile(conf.FilePath)
+	})
+	if checksumErr != nil {
+		return meta, checksumErr
+	}
+	meta.SHA256 = checksum
+
+	return meta, nil
+}
+
+// hashFile returns the hex encoded SHA-256 of a file.
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("could not open %v for hashing: %w", name, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("could not hash %v: %w", name, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
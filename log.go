@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// logger records requests and the comings and goings of the server. It goes
+// nowhere until setupLogging points it somewhere.
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// setupLogging picks where the logs go based on -log-format. Text logs sit
+// alongside the rest of the output, while JSON goes to stderr one record per
+// line so it can be piped off without the QR code getting mixed in.
+func setupLogging(format string) {
+	if format == "json" {
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+		return
+	}
+	logger = slog.New(slog.NewTextHandler(output, nil))
+}
+
+// logWriter wraps a ResponseWriter to keep track of what was sent for the
+// request log.
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *logWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController get at the writer underneath, to flush
+// a stream for instance.
+func (w *logWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ReadFrom keeps sendfile in play, same as statusWriter.
+func (w *logWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.bytes += n
+	return n, err
+}
+
+// logRequests wraps a handler to log every request once it's been answered.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &logWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(lw, r)
+		bytesServed.Add(lw.bytes)
+		logger.Info("request",
+			"remote", r.RemoteAddr,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", lw.status,
+			"bytes", lw.bytes,
+			"duration", time.Since(start),
+		)
+	})
+}
@@ -18,7 +18,11 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"html/template"
 	"net"
 	"net/http"
@@ -26,14 +30,30 @@ import (
 	"time"
 
 	"io"
+	"io/fs"
+	"math"
+	"mime"
 	"mime/multipart"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
 
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/mdp/qrterminal"
+	"github.com/atotto/clipboard"
+	"golang.org/x/text/unicode/norm"
 )
 
 // Config stores all settings for an instance of RUFF.
@@ -42,134 +62,2026 @@ type Config struct {
 	Port      int
 	FilePath  string
 	FileName  string
+	URLPath   string
+	Alias     string
 	HideQR    bool
 	Uploading bool
 	Multiple  bool
+	Bind      string
+	MaxSize   byteSize
+	Accept    []string
+	Allow     []*net.IPNet
+	Open      bool
+	Version   bool
+	Text      string
+	Root      bool
+	Templates string
+	CORS      bool
+	JSON      bool
+	PerIP     bool
+	Total     int
+	MDNS      bool
+	Proxied   bool
+	Unix      string
+	Quiet     bool
+	Grace     time.Duration
+	Linger    time.Duration
+	Stall     time.Duration
+	Health    string
+	Wait      bool
+	UPnP      bool
+
+	KeepStructure bool
+	ContentType   string
+	LogFormat     string
+	State         string
+	Reshare       bool
+	MaxConns      int
+	Rate          int
+	Gzip          bool
+	Landing       bool
+	Uploads       int
+	QRPage        bool
+	DateDirs      bool
+	Metrics       bool
+	Secret        bool
+	ConfigFile    string
+	Controls      bool
+	DryRun        bool
+	HTTP2         bool
+	DeleteAfter   bool
+	Progress      bool
+	LANOnly       bool
+	Title         string
+	Logo          string
+	Clip          bool
+	Hostname      string
+	ToStdout      bool
+	Dedup         bool
+	Field         string
+	Webhook       string
+	Archive       bool
+	Tus           bool
+	MaxNameLength int
+	Preview       bool
+	GzipUploads   bool
+	Duplex        bool
+	KeepAlive     time.Duration
+	ReadBuffer    byteSize
+	WriteBuffer   byteSize
+	Fast          bool
+	Hyperlink     bool
+	Checksum      bool
+	Links         int
+	NoDecompress  bool
+	Verify        time.Duration
+	Banner        string
+
+	// Token is the random part of the path with -secret.
+	Token string
+	// Tokens are the random parts of each path with -tokens.
+	Tokens []string
+	// Relay is set when the file's a URL to pass along, not a file on disk.
+	Relay bool
+}
+
+// AcceptList is -accept the way the file picker's accept attribute wants it.
+// It's only a hint to the browser, the server still checks for itself.
+func (c Config) AcceptList() string {
+	return strings.Join(c.Accept, ",")
+}
+
+// FieldName is the form field the upload form sends files in.
+func (c Config) FieldName() string {
+	if c.Field == "" {
+		return "file"
+	}
+	return c.Field
+}
+
+// LogoURL is where the upload form finds -logo. A file gets served at /logo,
+// while a URL is left for the browser to fetch.
+func (c Config) LogoURL() string {
+	if c.Logo == "" || logoIsURL(c.Logo) {
+		return c.Logo
+	}
+	return c.UploadPath() + "logo"
+}
+
+// UploadPath is where the upload form lives, which is / unless it's sharing
+// with a file being sent under -duplex.
+func (c Config) UploadPath() string {
+	if c.Duplex {
+		return "/upload/"
+	}
+	return "/"
+}
+
+// sending reports whether there's a file being sent, which -duplex does
+// alongside taking uploads.
+func (c Config) sending() bool {
+	return c.Text == "" && (!c.Uploading || c.Duplex)
+}
+
+// logoIsURL reports whether -logo is a web address rather than a file.
+func logoIsURL(logo string) bool {
+	return strings.HasPrefix(logo, "http://") || strings.HasPrefix(logo, "https://")
+}
+
+// sharePath is where the file is served from when sending one.
+func (c Config) sharePath() string {
+	p := "/"
+	if c.Token != "" {
+		p += c.Token + "/"
+	}
+	switch {
+	case c.Root:
+	case c.URLPath != "":
+		p += c.URLPath
+	default:
+		p += c.FileName
+	}
+	return p
+}
+
+// defaultName is the name a file's sent under if -name doesn't say, which is
+// also where it's served unless -path says otherwise. It's "" if the path
+// doesn't end in a usable name, like / does.
+func defaultName(filePath string, archive bool) string {
+	name := filepath.Base(filePath)
+	if isRelay(filePath) {
+		u, _ := url.Parse(filePath)
+		name = path.Base(u.Path)
+	}
+	if archive {
+		// A directory given as . still has a name of its own.
+		if abs, err := filepath.Abs(filePath); err == nil {
+			name = filepath.Base(abs)
+		}
+		name += ".tar.gz"
+	}
+	if !validName(name) {
+		return ""
+	}
+	return name
+}
+
+// previewPath is where -preview shows the file, tucked under the token with
+// -secret.
+func (c Config) previewPath() string {
+	if c.Secret {
+		return "/" + c.Token + "/preview"
+	}
+	return "/preview"
+}
+
+// checksumPath is where -checksum-file serves the file's checksum, at the
+// file's own path with .sha256 on the end.
+func (c Config) checksumPath() string {
+	p := c.sharePath()
+	if c.Root {
+		p += c.FileName
+	}
+	return p + ".sha256"
+}
+
+// validName reports whether name works as a single path segment, which goes
+// for both -name and -path.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
 }
 
 // getConfig fills in a Config struct based on the command line arguments.
 func getConfig() (Config, error) {
 	conf := Config{
 		Downloads: 1,
+		Total:     -1,
+		Uploads:   1,
+		Health:    "/healthz",
+		LogFormat: "text",
+		Stall:     time.Minute,
 		Port:      8008,
 		HideQR:    false,
 		Uploading: false,
 		Multiple:  true,
+
+		MaxNameLength: 255,
 	}
 
-	flag.IntVar(&conf.Downloads, "count", conf.Downloads, "number of downloads before exiting. set to -1 for unlimited downloads.")
+	flag.IntVar(&conf.Downloads, "count", conf.Downloads, "number of downloads before exiting. set to -1 for unlimited downloads, or 0 for unlimited until Enter is pressed.")
+	flag.BoolVar(&conf.Wait, "wait", conf.Wait, "stop serving when Enter is pressed, or when -count runs out, whichever comes first.")
+	flag.BoolVar(&conf.Controls, "controls", conf.Controls, "take commands from the terminal: a and Enter aborts transfers in progress, q and Enter quits.")
+	flag.BoolVar(&conf.PerIP, "per-ip", conf.PerIP, "apply -count to each device separately instead of to everyone combined.")
+	flag.IntVar(&conf.Total, "total", conf.Total, "with -per-ip, number of downloads across all devices before exiting. set to -1 for unlimited.")
+	flag.BoolVar(&conf.Checksum, "checksum-file", conf.Checksum, "serve a line for sha256sum -c at the file's path plus .sha256. doesn't count as a download.")
+	flag.BoolVar(&conf.Preview, "preview", conf.Preview, "show text and images at /preview, so they can be looked at without using up a download.")
+	flag.BoolVar(&conf.Archive, "compress-dir", conf.Archive, "send a directory as a tar.gz, packed on the fly as it's downloaded.")
+	flag.BoolVar(&conf.DeleteAfter, "delete-after", conf.DeleteAfter, "delete the file once the last download has gone through in full.")
+	flag.StringVar(&conf.State, "state", conf.State, "file to keep the number of downloads left in, so restarting RUFF picks up where it left off.")
 	flag.IntVar(&conf.Port, "port", conf.Port, "port to serve file on.")
+	flag.StringVar(&conf.Unix, "unix", conf.Unix, "listen on a unix socket at this path instead of a TCP port.")
 	flag.BoolVar(&conf.HideQR, "hide-qr", conf.HideQR, "hide the QR code.")
+	flag.BoolVar(&conf.Clip, "clip", conf.Clip, "copy the URL to the clipboard.")
+	flag.BoolVar(&conf.Hyperlink, "hyperlink", conf.Hyperlink, "make the printed URLs clickable in terminals that support it. left plain when output isn't a terminal.")
+	flag.BoolVar(&conf.QRPage, "qr-page", conf.QRPage, "serve a printable page with the QR code and URL at /qr.")
+	flag.BoolVar(&conf.Quiet, "quiet", conf.Quiet, "print nothing but errors, not even the URL.")
+	flag.StringVar(&conf.LogFormat, "log-format", conf.LogFormat, "format of the request and event logs, text or json. json logs go to stderr, one record per line.")
 	flag.BoolVar(&conf.Uploading, "upload", false, "upload files instead of downloading")
 	flag.BoolVar(&conf.Multiple, "multiple", conf.Multiple, "allow uploading multiple files at once")
+	flag.BoolVar(&conf.Duplex, "duplex", conf.Duplex, "send the file and take uploads at /upload at the same time, exiting once both are done.")
+	flag.StringVar(&conf.Title, "title", conf.Title, "title and heading for the upload form.")
+	flag.StringVar(&conf.Banner, "banner", conf.Banner, "short message to show at the top of the upload form and the -landing page, e.g. \"from Alice's laptop, gone at 5pm\".")
+	flag.StringVar(&conf.Logo, "logo", conf.Logo, "image file or http(s) URL to show at the top of the upload form.")
+	flag.IntVar(&conf.Uploads, "uploads", conf.Uploads, "number of uploads to take before exiting. set to -1 for unlimited uploads.")
+	flag.BoolVar(&conf.Progress, "progress", conf.Progress, "stream how far uploads have got as server-sent events at /progress.")
+	flag.BoolVar(&conf.ToStdout, "to-stdout", conf.ToStdout, "write the uploaded file to stdout instead of saving it, for piping into another program. takes a single file, and everything else RUFF prints goes to stderr.")
+	flag.BoolVar(&conf.Reshare, "reshare", conf.Reshare, "keep running after an upload and serve the uploaded files back, replying with their URLs.")
+	flag.DurationVar(&conf.Verify, "verify", conf.Verify, "once the last upload's in, keep serving what came in back at its URL for this long so the sender can check it, e.g. 10m.")
+	flag.BoolVar(&conf.NoDecompress, "no-decompress", conf.NoDecompress, "save uploads sent with Content-Encoding gzip or deflate as they came, instead of decompressing them.")
+	flag.BoolVar(&conf.GzipUploads, "compress-upload", conf.GzipUploads, "gzip uploads as they're saved, adding .gz to their names. files that are already compressed are saved as-is.")
+	flag.StringVar(&conf.Field, "field", conf.Field, "only take files sent in this form field, and have the upload form use it. any field is fine if unset.")
+	flag.IntVar(&conf.MaxNameLength, "max-filename-length", conf.MaxNameLength, "longest an uploaded file's name can be in bytes, cutting down longer ones but keeping the extension. 0 leaves them be.")
+	flag.BoolVar(&conf.Tus, "tus", conf.Tus, "also take resumable uploads over the tus protocol at /tus/, so a dropped connection doesn't mean starting over.")
+	flag.BoolVar(&conf.Dedup, "dedup", conf.Dedup, "throw away uploads identical to a file already in the upload directory, saying which one in the receipt.")
+	flag.BoolVar(&conf.DateDirs, "subdir-by-date", conf.DateDirs, "save uploads into a YYYY-MM-DD directory for the day they arrived.")
+	flag.BoolVar(&conf.KeepStructure, "keep-structure", conf.KeepStructure, "upload whole folders, recreating their directory structure.")
+	flag.BoolVar(&conf.HTTP2, "http2", conf.HTTP2, "speak HTTP/2 over plain HTTP to clients that ask for it, falling back to HTTP/1.1 for the rest.")
+	flag.IntVar(&conf.MaxConns, "max-conns", conf.MaxConns, "most requests to handle at once, turning away the rest. unlimited if 0.")
+	flag.StringVar(&conf.Webhook, "webhook", conf.Webhook, "URL to POST a JSON summary of each finished download or upload to.")
+	flag.IntVar(&conf.Rate, "rate", conf.Rate, "most requests a minute from each device, turning away the rest. unlimited if 0.")
+	flag.DurationVar(&conf.KeepAlive, "keepalive", conf.KeepAlive, "how often to check an idle connection's still there, e.g. 30s. 0 leaves it at 15s, -1 turns it off.")
+	flag.Var(&conf.ReadBuffer, "read-buffer", "size of each connection's receive buffer, e.g. 4M. left to the OS if unset.")
+	flag.Var(&conf.WriteBuffer, "write-buffer", "size of each connection's send buffer, e.g. 4M. left to the OS if unset.")
+	flag.BoolVar(&conf.Fast, "fast", conf.Fast, "tune for big transfers over a fast LAN, with 4M buffers unless -read-buffer or -write-buffer say otherwise.")
+	flag.StringVar(&conf.Bind, "bind", conf.Bind, "address to listen on. listens on all interfaces if unset.")
+	flag.Var(&conf.MaxSize, "max-size", "largest upload to accept, e.g. 100M or 2G. unlimited if unset.")
+	flag.BoolVar(&conf.JSON, "json", conf.JSON, "speak JSON instead of HTML for scripts. uploads may be a raw POST body named with ?name=, downloads get a /meta endpoint.")
+	flag.BoolVar(&conf.LANOnly, "lan-only", conf.LANOnly, "refuse to start if RUFF would be listening on an address reachable from the internet.")
+	flag.StringVar(&conf.Hostname, "hostname", conf.Hostname, "host to put in the URL and QR code instead of this machine's address, e.g. files.example.com or files.example.com:8080. doesn't change what RUFF listens on.")
+	flag.BoolVar(&conf.UPnP, "upnp", conf.UPnP, "ask the router to open the port with UPnP and use the external address in the URL.")
+	flag.BoolVar(&conf.MDNS, "mdns", conf.MDNS, "advertise as ruff.local over multicast DNS and use that in the URL.")
+	flag.BoolVar(&conf.Proxied, "trust-proxy", conf.Proxied, "trust X-Real-IP and X-Forwarded-For headers for the client's address. only use behind a reverse proxy.")
+	flag.BoolVar(&conf.CORS, "cors", conf.CORS, "add CORS headers so web pages on other origins can fetch from RUFF.")
+	flag.StringVar(&conf.Templates, "template-dir", conf.Templates, "directory of *.html files overriding the built-in templates by name with {{define \"UploadForm\"}} etc.")
+	flag.StringVar(&conf.ContentType, "content-type", conf.ContentType, "content type to serve the file as, if its extension is missing or misleading.")
+	flag.BoolVar(&conf.Landing, "landing", conf.Landing, "show a page with the file's name, size, and a download button at / instead of redirecting straight to the file.")
+	flag.BoolVar(&conf.Gzip, "gzip", conf.Gzip, "compress the file on the way out if the client can take it and it isn't compressed already.")
+	flag.BoolVar(&conf.Metrics, "metrics", conf.Metrics, "serve Prometheus metrics at /metrics.")
+	flag.BoolVar(&conf.Secret, "secret", conf.Secret, "serve the file under a random path so only people with the link can find it.")
+	flag.IntVar(&conf.Links, "tokens", conf.Links, "hand out this many one-time links instead, each under its own random path and good for one whole download. -count doesn't apply.")
+	flag.StringVar(&conf.FileName, "name", conf.FileName, "name the file is saved as on the other end. defaults to the file's own name.")
+	flag.StringVar(&conf.URLPath, "path", conf.URLPath, "path to serve the file at, e.g. dl for /dl. defaults to the name from -name.")
+	flag.StringVar(&conf.Alias, "alias", conf.Alias, "another path to serve the file at as well, e.g. latest for /latest. both count towards -count.")
+	flag.BoolVar(&conf.Root, "root", conf.Root, "serve the file directly at / instead of redirecting to /<filename>.")
+	flag.StringVar(&conf.Text, "text", conf.Text, "share a snippet of text instead of a file. use - to read it from stdin.")
+	flag.StringVar(&conf.ConfigFile, "config", conf.ConfigFile, "file of settings to use when they're not given as flags, one per line like port = 9000. defaults to "+defaultConfigFile()+".")
+	flag.BoolVar(&conf.DryRun, "dry-run", conf.DryRun, "check everything and show the URL and QR code, then exit without serving.")
+	flag.BoolVar(&conf.Version, "version", conf.Version, "print the version and exit.")
+	flag.StringVar(&conf.Health, "health-path", conf.Health, "path of the health check endpoint. set to an empty string to disable it.")
+	flag.DurationVar(&conf.Stall, "stall-timeout", conf.Stall, "how long a transfer can go without making any progress before it's cut off. 0 waits forever.")
+	flag.DurationVar(&conf.Grace, "grace", conf.Grace, "how long to let transfers finish when shutting down, e.g. 30s. 0 waits as long as it takes.")
+	flag.DurationVar(&conf.Linger, "linger", conf.Linger, "how long to keep telling latecomers the transfer's over before shutting down once it's done, e.g. 10s. 0 shuts down straight away.")
+	flag.BoolVar(&conf.Open, "open", conf.Open, "open the URL in the default browser.")
+	accept := flag.String("accept", "", "comma-separated list of file extensions to accept for upload, e.g. .jpg,.png. accepts anything if unset.")
+	allow := flag.String("allow", "", "comma-separated list of networks allowed to connect, e.g. 192.168.1.0/24,10.0.0.5/32. anyone can if unset.")
 
-	flag.IntVar(&conf.Downloads, "c", conf.Downloads, "number of downloads before exiting. set to -1 for unlimited downloads. (shorthand)")
+	flag.IntVar(&conf.Downloads, "c", conf.Downloads, "number of downloads before exiting. set to -1 for unlimited downloads, or 0 for unlimited until Enter is pressed. (shorthand)")
 	flag.IntVar(&conf.Port, "p", conf.Port, "port to serve file on. (shorthand)")
 	flag.BoolVar(&conf.HideQR, "q", conf.HideQR, "hide the QR code. (shorthand)")
+	flag.BoolVar(&conf.Quiet, "s", conf.Quiet, "print nothing but errors, not even the URL. (shorthand)")
 	flag.BoolVar(&conf.Uploading, "u", false, "upload files instead of downloading (shorthand)")
 	flag.BoolVar(&conf.Multiple, "m", conf.Multiple, "allow uploading multiple files at once (shorthand)")
 
 	flag.Parse()
+
+	// Flags beat the config file, which beats the defaults.
+	configFile, required := conf.ConfigFile, true
+	if configFile == "" {
+		configFile, required = defaultConfigFile(), false
+	}
+	if configFile != "" {
+		err := applyConfigFile(configFile, required)
+		if err != nil {
+			return conf, err
+		}
+	}
+
 	conf.FilePath = flag.Arg(0)
-	conf.FileName = path.Base(conf.FilePath)
+	conf.Relay = isRelay(conf.FilePath)
+	named, pathed := conf.FileName != "", conf.URLPath != ""
+	if !named {
+		conf.FileName = defaultName(conf.FilePath, conf.Archive)
+	}
+
+	if conf.Version {
+		return conf, nil
+	}
+
+	// Counting down from 0 never hits 0, so it's unlimited, but it'd be nice
+	// to have a way to stop without Ctrl+C.
+	if conf.Downloads == 0 {
+		conf.Wait = true
+	}
+
+	// Everything that goes for uploads goes for -duplex's too.
+	if conf.Duplex {
+		conf.Uploading = true
+	}
 
-	if conf.FilePath == "" && !conf.Uploading {
+	if conf.Text != "" {
+		if conf.Uploading || conf.FilePath != "" {
+			return conf, errors.New("can't share text alongside a file or upload form")
+		}
+		if conf.Text == "-" {
+			text, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return conf, fmt.Errorf("could not read text from stdin: %w", err)
+			}
+			conf.Text = strings.TrimSuffix(string(text), "\n")
+		}
+		if conf.Text == "" {
+			return conf, errors.New("no text provided")
+		}
+	}
+
+	if conf.FilePath == "" && conf.sending() {
 		return conf, errors.New("no file provided")
 	}
 
+	// Better to find out the file's no good now than when somebody's trying
+	// to download it. A URL's fetched when it's needed, so it'll have to wait.
+	if conf.sending() && !conf.Relay {
+		f, err := os.Open(conf.FilePath)
+		if err != nil {
+			return conf, fmt.Errorf("could not read file: %w", err)
+		}
+		info, err := f.Stat()
+		f.Close()
+		if err != nil {
+			return conf, fmt.Errorf("could not read file: %w", err)
+		}
+		if info.IsDir() && !conf.Archive {
+			return conf, fmt.Errorf("%v is a directory, send it as a tar.gz with -compress-dir", conf.FilePath)
+		}
+		if !info.IsDir() && conf.Archive {
+			return conf, fmt.Errorf("%v isn't a directory, -compress-dir is for sending one", conf.FilePath)
+		}
+		if info.Size() == 0 && !conf.Archive {
+			fmt.Fprintf(os.Stderr, "warning: %v is empty, sending it anyway\n", conf.FilePath)
+		}
+	}
+
+	// -name only goes in the Content-Disposition header and -path only in the
+	// URL, so the link can be short while the download keeps a good name.
+	if (named || pathed) && !conf.sending() {
+		return conf, errors.New("-name and -path only apply when sending a file")
+	}
+	if named && !validName(conf.FileName) {
+		return conf, fmt.Errorf("invalid name %q, it can't be empty or have a / in it", conf.FileName)
+	}
+	// Served at a name like / or ., the file would redirect to itself.
+	if !named && conf.sending() && conf.FileName == "" {
+		return conf, fmt.Errorf("can't tell what to call %v, give it a name with -name", conf.FilePath)
+	}
+	conf.URLPath = strings.TrimPrefix(conf.URLPath, "/")
+	if pathed && conf.Root {
+		return conf, errors.New("-path and -root both say where the file goes, pick one")
+	}
+	if pathed && !validName(conf.URLPath) {
+		return conf, fmt.Errorf("invalid path %q, it has to be a single segment like dl", conf.URLPath)
+	}
+	if !pathed {
+		conf.URLPath = conf.FileName
+	}
+
+	for _, ext := range strings.Split(*accept, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		conf.Accept = append(conf.Accept, ext)
+	}
+
+	for _, cidr := range strings.Split(*allow, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return conf, fmt.Errorf("invalid -allow %q, networks look like 192.168.1.0/24", cidr)
+		}
+		conf.Allow = append(conf.Allow, network)
+	}
+	// Unix sockets don't come with an address to check.
+	if len(conf.Allow) > 0 && conf.Unix != "" && !conf.Proxied {
+		return conf, errors.New("-allow can't tell who's connecting over -unix without -trust-proxy")
+	}
+
+	// Extra endpoints that sit alongside whatever's being shared. When sending
+	// a file they leave no room for one with the same name, unless it's being
+	// served from / instead.
+	sending := conf.sending()
+	if conf.Archive && !sending {
+		return conf, errors.New("-compress-dir is for sending a directory, it can't be used when uploading or sharing text")
+	}
+	// A URL's only fetched as it's sent, so there's nothing on disk to look
+	// at, compress, or delete.
+	conf.Relay = conf.Relay && sending
+	if conf.Relay && (conf.Archive || conf.Gzip || conf.DeleteAfter || conf.Preview || conf.Checksum) {
+		return conf, errors.New("-compress-dir, -gzip, -delete-after, -preview, and -checksum-file need the file on disk, they can't be used when sending a URL")
+	}
+	// Neither an archive nor a URL has a size or checksum until it's been
+	// sent.
+	var endpoints []string
+	if conf.JSON && sending && !conf.Archive && !conf.Relay {
+		endpoints = append(endpoints, "/meta")
+	}
+	// With -secret it's tucked away under the token with the file.
+	if sending && !conf.Secret && !conf.Archive && !conf.Relay {
+		endpoints = append(endpoints, "/meta.json")
+	}
+	if sending && conf.Secret && !conf.Root && conf.URLPath == "meta.json" {
+		return conf, errors.New("the file's path /meta.json is in the way of /meta.json, move it with -path or serve it with -root")
+	}
+	if conf.Preview {
+		if !sending || conf.Archive {
+			return conf, errors.New("-preview shows the file being sent, it can't be used when uploading, sharing text, or with -compress-dir")
+		}
+		// With -secret it's tucked away under the token, like /meta.json.
+		if !conf.Secret {
+			endpoints = append(endpoints, "/preview")
+		}
+	}
+	if conf.Checksum {
+		if !sending || conf.Archive {
+			return conf, errors.New("-checksum-file is for the file being sent, it can't be used when uploading, sharing text, or with -compress-dir")
+		}
+		if !conf.Secret {
+			endpoints = append(endpoints, conf.checksumPath())
+		}
+	}
+	if sending && conf.Secret && !conf.Root && conf.Preview && conf.URLPath == "preview" {
+		return conf, errors.New("the file's path /preview is in the way of /preview, move it with -path or serve it with -root")
+	}
+	if conf.QRPage {
+		endpoints = append(endpoints, "/qr")
+	}
+	if conf.Metrics {
+		endpoints = append(endpoints, "/metrics")
+	}
+	// Everything to do with uploads goes under /upload with -duplex.
+	if conf.Duplex {
+		endpoints = append(endpoints, "/upload")
+	}
+	if conf.Field != "" && !conf.Uploading {
+		return conf, errors.New("-field is for uploads, it needs -upload")
+	}
+	if conf.MaxNameLength < 0 {
+		return conf, fmt.Errorf("invalid -max-filename-length %v", conf.MaxNameLength)
+	}
+	if conf.Tus && (!conf.Uploading || conf.ToStdout || conf.GzipUploads) {
+		return conf, errors.New("-tus saves uploads as they arrive, it needs -upload and can't be used with -to-stdout or -compress-upload")
+	}
+	if conf.Dedup && (!conf.Uploading || conf.ToStdout || conf.GzipUploads) {
+		return conf, errors.New("-dedup compares saved uploads as they are, it needs -upload and can't be used with -to-stdout or -compress-upload")
+	}
+	if conf.Verify < 0 {
+		return conf, fmt.Errorf("invalid -verify %v", conf.Verify)
+	}
+	if conf.Verify > 0 && (!conf.Uploading || conf.ToStdout || conf.Reshare) {
+		return conf, errors.New("-verify serves back what was uploaded, it needs -upload and can't be used with -to-stdout, or with -reshare, which serves it back anyway")
+	}
+	if conf.Verify > 0 && conf.Uploads < 0 {
+		return conf, errors.New("-verify starts once the last upload's in, so it needs a limit on -uploads")
+	}
+	if conf.NoDecompress && !conf.Uploading {
+		return conf, errors.New("-no-decompress is for saving uploads, it needs -upload")
+	}
+	if conf.GzipUploads && !conf.Uploading {
+		return conf, errors.New("-compress-upload is for saving uploads, it needs -upload")
+	}
+	if conf.Banner != "" && !conf.Uploading && !conf.Landing {
+		return conf, errors.New("-banner shows on the upload form and the -landing page, it needs -upload or -landing")
+	}
+	if (conf.Title != "" || conf.Logo != "") && !conf.Uploading {
+		return conf, errors.New("-title and -logo are for the upload form, they need -upload")
+	}
+	if conf.Logo != "" && !logoIsURL(conf.Logo) {
+		f, err := os.Open(conf.Logo)
+		if err != nil {
+			return conf, fmt.Errorf("could not read logo: %w", err)
+		}
+		f.Close()
+		endpoints = append(endpoints, conf.UploadPath()+"logo")
+	}
+	if conf.Progress {
+		if !conf.Uploading {
+			return conf, errors.New("-progress follows uploads, it needs -upload")
+		}
+		endpoints = append(endpoints, conf.UploadPath()+"progress")
+	}
+	if sending && !conf.Root {
+		for _, endpoint := range endpoints {
+			if "/"+conf.URLPath == endpoint {
+				return conf, fmt.Errorf("the file's path /%v is in the way of %v, move it with -path or serve it with -root", conf.URLPath, endpoint)
+			}
+		}
+	}
+
+	// The alias is a second way in to the file, so it's held to the same
+	// rules as -path.
+	conf.Alias = strings.TrimPrefix(conf.Alias, "/")
+	if conf.Alias != "" {
+		if !sending {
+			return conf, errors.New("-alias only applies when sending a file")
+		}
+		if conf.Secret {
+			return conf, errors.New("-alias would give away the file's -secret path")
+		}
+		if !validName(conf.Alias) {
+			return conf, fmt.Errorf("invalid alias %q, it has to be a single segment like latest", conf.Alias)
+		}
+		if !conf.Root && conf.Alias == conf.URLPath {
+			return conf, fmt.Errorf("the file's already at /%v, pick a different -alias", conf.Alias)
+		}
+		for _, endpoint := range append(endpoints, "/favicon.ico") {
+			if "/"+conf.Alias == endpoint {
+				return conf, fmt.Errorf("-alias /%v is in the way of %v", conf.Alias, endpoint)
+			}
+		}
+	}
+
+	if conf.Health != "" {
+		if !strings.HasPrefix(conf.Health, "/") || conf.Health == "/" {
+			return conf, fmt.Errorf("invalid health check path %q", conf.Health)
+		}
+		// The health check can't share a route with anything else.
+		routes := endpoints
+		if sending {
+			routes = append(routes, "/favicon.ico")
+			if !conf.Root {
+				routes = append(routes, "/"+conf.URLPath)
+			}
+			if conf.Alias != "" {
+				routes = append(routes, "/"+conf.Alias)
+			}
+		}
+		for _, route := range routes {
+			if conf.Health == route {
+				return conf, fmt.Errorf("the health check is in the way of %v, move it with -health-path", route)
+			}
+		}
+	}
+
+	// There's one stdout, so one file to write to it.
+	if conf.ToStdout {
+		if !conf.Uploading {
+			return conf, errors.New("-to-stdout is for uploads, it needs -upload")
+		}
+		if conf.Uploads != 1 || conf.Reshare || conf.KeepStructure || conf.DateDirs || conf.GzipUploads {
+			return conf, errors.New("-to-stdout takes a single file and doesn't save it, so it can't be used with -uploads, -reshare, -keep-structure, -subdir-by-date, or -compress-upload")
+		}
+		conf.Multiple = false
+	}
+
+	if conf.KeepStructure && !conf.Multiple {
+		return conf, errors.New("-keep-structure uploads whole folders, it can't be used with -multiple=false")
+	}
+
+	if conf.DeleteAfter {
+		if conf.Archive {
+			return conf, errors.New("-delete-after won't delete a whole directory, it can't be used with -compress-dir")
+		}
+		if !sending {
+			return conf, errors.New("-delete-after only deletes a file being sent, it can't be used when uploading or sharing text")
+		}
+		limit := conf.Downloads
+		if conf.PerIP {
+			limit = conf.Total
+		}
+		if conf.Links > 0 {
+			limit = conf.Links
+		}
+		if limit <= 0 {
+			return conf, errors.New("-delete-after needs a download limit, or there's never a last download to delete after")
+		}
+	}
+
+	if conf.State != "" {
+		if !sending {
+			return conf, errors.New("-state only keeps track of downloads, it can't be used when uploading or sharing text")
+		}
+		limit := conf.Downloads
+		if conf.PerIP {
+			limit = conf.Total
+		}
+		if limit <= 0 {
+			return conf, errors.New("-state needs a download limit to keep track of")
+		}
+	}
+
+	if conf.Secret {
+		if !sending {
+			return conf, errors.New("-secret only hides downloads, it can't be used when uploading or sharing text")
+		}
+		if conf.Landing {
+			return conf, errors.New("-landing would give away the -secret path, they can't be used together")
+		}
+		token := make([]byte, 8)
+		_, err := rand.Read(token)
+		if err != nil {
+			return conf, fmt.Errorf("could not make a secret path: %w", err)
+		}
+		conf.Token = hex.EncodeToString(token)
+	}
+
+	if conf.Links < 0 {
+		return conf, fmt.Errorf("invalid -tokens %v", conf.Links)
+	}
+	if conf.Links > 0 {
+		if !sending {
+			return conf, errors.New("-tokens is for sending a file, it can't be used when uploading or sharing text")
+		}
+		// Anything else that hands out the file, or the way to it, would get
+		// around the links being good for one download each.
+		if conf.Secret || conf.Alias != "" || conf.Landing || conf.PerIP || conf.Preview || conf.QRPage || conf.Open || conf.State != "" {
+			return conf, errors.New("-tokens hands out its own one-time links, it can't be used with -secret, -alias, -landing, -per-ip, -preview, -qr-page, -open, or -state")
+		}
+		tokens, err := makeTokens(conf.Links)
+		if err != nil {
+			return conf, err
+		}
+		conf.Tokens = tokens
+	}
+
+	if conf.QRPage && conf.Unix != "" && conf.Hostname == "" {
+		return conf, errors.New("-qr-page needs a URL to show, it can't be used with -unix unless there's a -hostname")
+	}
+
+	if conf.Uploads == 0 || conf.Uploads < -1 {
+		return conf, fmt.Errorf("invalid -uploads %v, set it to -1 for unlimited uploads", conf.Uploads)
+	}
+
+	if conf.Landing && conf.Root {
+		return conf, errors.New("-landing needs / for itself, it can't be used with -root")
+	}
+
+	if conf.Stall < 0 {
+		return conf, errors.New("-stall-timeout can't be negative, set it to 0 to wait forever")
+	}
+
+	if conf.MaxConns < 0 {
+		return conf, fmt.Errorf("invalid -max-conns %v", conf.MaxConns)
+	}
+	if conf.Rate < 0 {
+		return conf, fmt.Errorf("invalid -rate %v", conf.Rate)
+	}
+	if conf.Webhook != "" {
+		u, err := url.Parse(conf.Webhook)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return conf, fmt.Errorf("invalid -webhook %q, it needs to be an http or https URL", conf.Webhook)
+		}
+	}
+
+	if conf.LogFormat != "text" && conf.LogFormat != "json" {
+		return conf, fmt.Errorf("unknown log format %q, use text or json", conf.LogFormat)
+	}
+
+	if conf.KeepAlive != 0 && conf.Unix != "" {
+		return conf, errors.New("-keepalive is for TCP connections, it can't be used with -unix")
+	}
+	if conf.ReadBuffer > maxBuffer || conf.WriteBuffer > maxBuffer {
+		return conf, errors.New("-read-buffer and -write-buffer can't be more than 1G")
+	}
+	if conf.Fast {
+		if conf.ReadBuffer == 0 {
+			conf.ReadBuffer = fastBuffer
+		}
+		if conf.WriteBuffer == 0 {
+			conf.WriteBuffer = fastBuffer
+		}
+	}
+
+	if conf.UPnP && conf.Unix != "" {
+		return conf, errors.New("-upnp needs a TCP port to forward, it can't be used with -unix")
+	}
+
+	if conf.Bind != "" && net.ParseIP(conf.Bind) == nil {
+		return conf, fmt.Errorf("invalid bind address %q", conf.Bind)
+	}
+
+	if conf.Hostname != "" {
+		if strings.ContainsAny(conf.Hostname, "/?#@ ") {
+			return conf, fmt.Errorf("invalid hostname %q, it should be a bare host like files.example.com", conf.Hostname)
+		}
+		if conf.MDNS {
+			return conf, errors.New("-mdns and -hostname both pick the host for the URL, pick one")
+		}
+	}
+
+	if conf.Clip && conf.Unix != "" && conf.Hostname == "" {
+		return conf, errors.New("there's no URL to copy with -unix, so -clip can't be used with it")
+	}
+
+	if conf.LANOnly {
+		if conf.UPnP {
+			return conf, errors.New("-upnp opens RUFF up to the internet, it can't be used with -lan-only")
+		}
+		if conf.Unix != "" {
+			return conf, errors.New("-lan-only checks the address RUFF listens on, it can't be used with -unix")
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return conf, fmt.Errorf("could not list network addresses: %w", err)
+		}
+		err = checkLAN(conf.Bind, addrs)
+		if err != nil {
+			return conf, err
+		}
+	}
+
 	return conf, nil
 }
 
-// getIP uses the net package to try and determine the local address of the
-// device it's running on.
-//
-// Note: I guess since this is a UDP connection, nothing is actually sent, no
-// connection is established. Target doesn't even need to really exist for us
-// to be able to grab the local address.
-func getIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return "", err
+// version can be set at build time with -ldflags "-X main.version=v1.2.3".
+// Otherwise it comes from the module info baked in by the go tool.
+var version string
+
+// getVersion describes which build of RUFF this is, including the VCS revision
+// when it's known.
+func getVersion() string {
+	v := version
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if v == "" {
+			v = "unknown"
+		}
+		return v
+	}
+
+	if v == "" {
+		v = info.Main.Version
 	}
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	rev, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			rev = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	// Newer toolchains already fold the revision into a pseudo-version.
+	if rev != "" && !strings.Contains(v, rev) {
+		if modified {
+			rev += "-dirty"
+		}
+		v += " (" + rev + ")"
+	}
 
-	return localAddr.IP.String(), nil
+	return v
 }
 
-// done is used to signal that the HTTP server has finished gracefully
-// shutting down.
-var done = make(chan struct{})
+// byteSize is a number of bytes that can be set from a flag using suffixes
+// like 100K, 20M, or 2G. Suffixes are powers of 1024.
+type byteSize int64
 
-func main() {
-	conf, err := getConfig()
-	if err != nil {
-		fmt.Printf("config error: %v\n", err)
-		os.Exit(1)
+var sizeSuffixes = "KMGTPE"
+
+// String formats the size using the largest suffix that divides it evenly.
+func (b *byteSize) String() string {
+	n := int64(*b)
+	suffix := ""
+	for i := 0; i < len(sizeSuffixes) && n != 0 && n%1024 == 0; i++ {
+		n /= 1024
+		suffix = sizeSuffixes[i : i+1]
 	}
+	return strconv.FormatInt(n, 10) + suffix
+}
 
-	server := &http.Server{
-		Addr:         fmt.Sprintf(":%v", conf.Port),
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+// Set parses a size such as "512", "100M", or "2GB".
+func (b *byteSize) Set(s string) error {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if len(num) > 0 {
+		if i := strings.IndexByte(sizeSuffixes, num[len(num)-1]); i >= 0 {
+			num = num[:len(num)-1]
+			mult = 1 << (10 * uint(i+1))
+		}
 	}
 
-	if conf.Uploading {
-		setupUpload(server, conf)
-	} else {
-		setupDownload(server, conf)
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/mult {
+		return fmt.Errorf("size %q is too large", s)
 	}
 
-	ip, err := getIP()
-	if err != nil {
-		fmt.Printf("failed to look up local IP: %v\n", err)
-		os.Exit(1)
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// humanSize formats a number of bytes for people to read, e.g. 1.5 MiB.
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	size := float64(n) / 1024
+	i := 0
+	for size >= 1024 && i < len(sizeSuffixes)-1 {
+		size /= 1024
+		i++
 	}
+	return fmt.Sprintf("%.1f %ciB", size, sizeSuffixes[i])
+}
 
-	url := fmt.Sprintf("http://%s:%v/%s", ip, conf.Port, conf.FileName)
-	if conf.Uploading {
-		url = fmt.Sprintf("http://%s:%v", ip, conf.Port)
+// getIP uses the net package to try and determine the local address of the
+// device it's running on.
+//
+// Note: I guess since this is a UDP connection, nothing is actually sent, no
+// connection is established. Target doesn't even need to really exist for us
+// to be able to grab the local address.
+func getIP() (string, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err == nil {
+		defer conn.Close()
+		localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+		if ok && !localAddr.IP.IsLoopback() && !localAddr.IP.IsUnspecified() {
+			return localAddr.IP.String(), nil
+		}
 	}
-	if !conf.HideQR {
-		qrterminal.GenerateHalfBlock(url, qrterminal.M, os.Stdout)
+
+	// Without a default route the trick above falls flat, but a LAN with no
+	// internet is no reason not to share a file over it.
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("could not list network addresses: %w", err)
 	}
-	fmt.Println(url)
+	return pickIP(addrs)
+}
 
-	err = server.ListenAndServe()
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		fmt.Printf("server exited with error: %v\n", err)
-		os.Exit(1)
+// pickIP picks the address most likely to be reachable by other devices on
+// the LAN out of the ones our interfaces have. Private IPv4 addresses win over
+// IPv6 ones, since they're what people expect to type.
+func pickIP(addrs []net.Addr) (string, error) {
+	var v6 net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsPrivate() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+		if v6 == nil {
+			v6 = ipnet.IP
+		}
 	}
 
-	// Wait for the server to finish any transfers, up to 3 seconds
-	select {
-	case <-done:
-	case <-time.After(3 * time.Second):
+	if v6 == nil {
+		return "", errors.New("no private network address found, pick one with -bind")
 	}
+	return v6.String(), nil
 }
 
-// setupDownload sets up the HTTP server for sending a file to a remote device.
-func setupDownload(server *http.Server, conf Config) {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("Incoming request: %v: %v %v %v\n", r.RemoteAddr, r.Proto, r.Method, r.URL)
-		// 303 redirect to real file.
-		http.RedirectHandler("/"+conf.FileName, http.StatusSeeOther).ServeHTTP(w, r)
-	})
+// cgnat is the shared address space ISPs use for carrier-grade NAT, RFC 6598.
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// local reports whether ip can only be reached from nearby: loopback,
+// link-local, RFC 1918 and IPv6 ULA addresses, or behind carrier-grade NAT.
+func local(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsPrivate() || cgnat.Contains(ip)
+}
+
+// checkLAN makes sure RUFF won't be listening anywhere public for -lan-only.
+// An empty or unspecified bind address listens on every interface, so then
+// every one of addrs has to be local.
+func checkLAN(bind string, addrs []net.Addr) error {
+	ip := net.ParseIP(bind)
+	if ip != nil && !ip.IsUnspecified() {
+		if !local(ip) {
+			return fmt.Errorf("%v is a public address, refusing to listen on it with -lan-only", ip)
+		}
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && !local(ipnet.IP) {
+			return fmt.Errorf("this machine has a public address, %v, so pick a private one with -bind to use -lan-only", ipnet.IP)
+		}
+	}
+	return nil
+}
+
+// health answers health checks from load balancers and the like, without
+// going anywhere near the download count.
+func health(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// cors wraps a handler with permissive CORS headers, answering preflight
+// requests itself so they never reach the download or upload handlers. The
+// exception is tusPath, if there is one, since OPTIONS is how tus clients find
+// out what the server supports, so the tus handler answers those.
+func cors(tusPath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, Content-Length, Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length")
+
+		if r.Method == http.MethodOptions && (tusPath == "" || !strings.HasPrefix(r.URL.Path, tusPath)) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowOnly wraps a handler so only devices on one of the allowed networks
+// get through, for -allow.
+func allowOnly(allowed []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(clientIP(r))
+		for _, network := range allowed {
+			if ip != nil && network.Contains(ip) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		logger.Info("not allowed", "remote", clientIP(r))
+		http.Error(w, "this device isn't allowed to connect", http.StatusForbidden)
+	})
+}
+
+// limitConns wraps a handler so no more than n requests are handled at once.
+// Anybody past that is told to come back later rather than left waiting.
+func limitConns(n int, next http.Handler) http.Handler {
+	sem := make(chan struct{}, n)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many connections, try again later", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// listen opens the listener the server will run on, either a unix socket or
+// a TCP port.
+func listen(conf Config, server *http.Server) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if conf.Unix == "" {
+		lc := net.ListenConfig{KeepAlive: conf.KeepAlive}
+		ln, err = lc.Listen(context.Background(), "tcp", server.Addr)
+	} else {
+		// Clear out a socket left behind by a previous run, being careful not
+		// to delete anything that isn't a socket. The listener removes the
+		// socket itself when the server shuts down.
+		info, statErr := os.Lstat(conf.Unix)
+		if statErr == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(conf.Unix)
+		}
+		ln, err = net.Listen("unix", conf.Unix)
+	}
+
+	if err != nil || conf.ReadBuffer == 0 && conf.WriteBuffer == 0 {
+		return ln, err
+	}
+	return tunedListener{ln, int(conf.ReadBuffer), int(conf.WriteBuffer)}, nil
+}
+
+// privileged reports whether listening failed because the port's one only
+// root gets to use.
+func privileged(conf Config, err error) bool {
+	return conf.Unix == "" && conf.Port > 0 && conf.Port < 1024 && errors.Is(err, fs.ErrPermission)
+}
+
+// openBrowser tries to open a link with whatever the platform uses to open
+// links.
+func openBrowser(link string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", link)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", link)
+	default:
+		cmd = exec.Command("xdg-open", link)
+	}
+	return cmd.Start()
+}
+
+// output is where everything but errors gets printed. Errors always go to
+// stderr.
+var output io.Writer = os.Stdout
+
+// done is used to signal that the HTTP server has finished gracefully
+// shutting down.
+var done = make(chan struct{})
+
+func main() {
+	conf, err := getConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if conf.Version {
+		fmt.Println("ruff", getVersion())
+		return
+	}
+
+	if conf.ToStdout {
+		output = os.Stderr
+	}
+	if conf.Quiet {
+		output = io.Discard
+	}
+	setupLogging(conf.LogFormat)
+
+	// Pick up the count from the last run, if there was one.
+	if conf.State != "" {
+		remaining, ok, err := loadState(conf.State)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if ok && remaining <= 0 {
+			fmt.Fprintf(os.Stderr, "there are no downloads left according to %v\n", conf.State)
+			os.Exit(1)
+		}
+		if ok && conf.PerIP {
+			conf.Total = remaining
+		} else if ok {
+			conf.Downloads = remaining
+		}
+	}
+
+	// A big file over slow WiFi can take ages, so there's no cap on how long
+	// a request can take, only on how long it can sit there doing nothing.
+	// See -stall-timeout.
+	server := &http.Server{
+		Addr:              net.JoinHostPort(conf.Bind, strconv.Itoa(conf.Port)),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+
+	tpl, err := loadTemplates(conf.Templates)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "template error: %v\n", err)
+		os.Exit(1)
+	}
+
+	mux := http.NewServeMux()
+	switch {
+	case conf.Duplex:
+		setupDuplex(mux, server, conf, tpl)
+	case conf.Uploading:
+		setupUpload(mux, server, conf, tpl)
+	case conf.Text != "":
+		setupText(mux, server, conf, tpl)
+	default:
+		setupDownload(mux, server, conf, tpl)
+	}
+
+	if conf.Health != "" {
+		mux.HandleFunc(conf.Health, health)
+	}
+	if conf.Metrics {
+		mux.HandleFunc("/metrics", metrics)
+		server.ConnState = trackConns
+	}
+	if conf.Controls {
+		server.ConnContext = saveConn
+	}
+
+	var handler http.Handler = turnAway(tpl, mux)
+	if conf.Stall > 0 {
+		handler = detectStalls(conf.Stall, handler)
+	}
+	if conf.CORS {
+		tusPath := ""
+		if conf.Tus {
+			tusPath = conf.UploadPath() + "tus/"
+		}
+		handler = cors(tusPath, handler)
+	}
+	if conf.MaxConns > 0 {
+		handler = limitConns(conf.MaxConns, handler)
+	}
+	if conf.Rate > 0 {
+		handler = limitRate(conf.Rate, handler)
+	}
+	if len(conf.Allow) > 0 {
+		handler = allowOnly(conf.Allow, handler)
+	}
+	if conf.Controls {
+		handler = trackTransfers(handler)
+	}
+	handler = logRequests(handler)
+	if conf.Proxied {
+		handler = trustProxy(handler)
+	}
+	if conf.HTTP2 {
+		handler, err = serveH2C(server, handler)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not set up HTTP/2: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	server.Handler = handler
+
+	// Listen before printing anything so a port that's already in use doesn't
+	// leave a useless QR code on screen. A dry run doesn't listen at all, it
+	// has already checked everything getConfig can.
+	var ln net.Listener
+	if !conf.DryRun {
+		ln, err = listen(conf, server)
+		if err != nil && privileged(conf, err) {
+			fmt.Fprintf(os.Stderr, "could not listen on port %v, ports below 1024 need root or the CAP_NET_BIND_SERVICE capability. try a higher one, like -p 8008\n", conf.Port)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not listen: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Show what's being sent, so it's easy to tell if it's the wrong thing.
+	if conf.Archive {
+		if files, size, err := dirSize(conf.FilePath); err == nil {
+			fmt.Fprintf(output, "sending %v (%v files, %v before compressing)\n", conf.FileName, files, humanSize(size))
+		}
+	} else if conf.Relay {
+		fmt.Fprintf(output, "sending %v from %v\n", conf.FileName, conf.FilePath)
+	} else if conf.sending() {
+		if info, err := os.Stat(conf.FilePath); err == nil {
+			ctype := fileType(conf)
+			if ctype == "" {
+				ctype = "unknown type"
+			}
+			fmt.Fprintf(output, "sending %v (%v, %v)\n", conf.FileName, humanSize(info.Size()), ctype)
+		}
+	}
+
+	url := ""
+	if conf.Unix != "" && conf.Hostname == "" {
+		fmt.Fprintln(output, "listening on a unix socket, so there's no URL or QR code to show:")
+		fmt.Fprintln(output, conf.Unix)
+	} else {
+		// Only go looking for our address if we weren't told which one to use,
+		// and it's actually going to be used.
+		ip := conf.Bind
+		if (ip == "" || net.ParseIP(ip).IsUnspecified()) && (conf.Hostname == "" || conf.UPnP) {
+			ip, err = getIP()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to look up local IP: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		hostname := ip
+		if conf.MDNS && !conf.DryRun {
+			mdns, err := advertise(ip, conf.Port)
+			if err != nil {
+				// Plenty of networks block multicast, so the IP will have to do.
+				fmt.Fprintf(os.Stderr, "warning: could not advertise over mDNS, using the IP instead: %v\n", err)
+			} else {
+				defer mdns.Shutdown()
+				hostname = mdnsName
+			}
+		}
+
+		if conf.UPnP && !conf.DryRun {
+			external, unmap, err := mapPort(ip, conf.Port)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: could not open port with UPnP, using the LAN address instead: %v\n", err)
+			} else {
+				defer unmap()
+				hostname = external
+			}
+		}
+
+		host := net.JoinHostPort(hostname, strconv.Itoa(conf.Port))
+		// -hostname is what people reach us at, whatever we're listening on.
+		// If it comes with a port, or there's no port to add, something like a
+		// reverse proxy is in front and knows better.
+		if conf.Hostname != "" {
+			host = conf.Hostname
+			if _, _, err := net.SplitHostPort(host); err != nil && conf.Unix == "" {
+				host = net.JoinHostPort(host, strconv.Itoa(conf.Port))
+			}
+		}
+		url = fmt.Sprintf("http://%s", host)
+		if p := conf.sharePath(); p != "/" && conf.sending() && !conf.Landing && len(conf.Tokens) == 0 {
+			url += p
+		}
+		// With -tokens there's no one URL, there's a link for each download.
+		links := []string{url}
+		if len(conf.Tokens) > 0 {
+			links = nil
+			for _, p := range conf.linkPaths() {
+				links = append(links, url+p)
+			}
+		}
+		link := func(l string) string {
+			if conf.Hyperlink {
+				return hyperlink(output, l)
+			}
+			return l
+		}
+		// showQR draws a QR code, or says why it can't.
+		showQR := func(text string) {
+			need, ok := drawQR(output, text)
+			if ok {
+				return
+			}
+			hint := "use -qr-page to show it in a browser instead"
+			if conf.QRPage {
+				hint = "open the printable one at /qr instead"
+			}
+			fmt.Fprintf(os.Stderr, "warning: the terminal's too narrow for the QR code, it needs %v columns. make the window wider, or %v\n", need, hint)
+		}
+		if len(conf.Tokens) > 0 {
+			for i, l := range links {
+				fmt.Fprintf(output, "link %v of %v, good for one download:\n", i+1, len(links))
+				if !conf.HideQR {
+					showQR(l)
+				}
+				fmt.Fprintln(output, link(l))
+			}
+		} else {
+			if !conf.HideQR {
+				// Short enough text goes straight in the QR code, no network
+				// required, as long as it fits.
+				var ok bool
+				if conf.Text != "" && len(conf.Text) <= maxTextQR {
+					_, ok = drawQR(output, conf.Text)
+				}
+				if ok {
+					fmt.Fprintln(output, "(the QR code contains the text itself)")
+				} else {
+					showQR(url)
+				}
+			}
+			fmt.Fprintln(output, link(url))
+		}
+
+		// Plenty of machines have no clipboard to speak of, like over SSH, and
+		// the URL's right there anyway.
+		if conf.Clip {
+			err := clipboard.WriteAll(strings.Join(links, "\n"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: could not copy the URL to the clipboard: %v\n", err)
+			}
+		}
+
+		if conf.Duplex {
+			upload := fmt.Sprintf("http://%s/upload", host)
+			fmt.Fprintln(output, "and to send files back:")
+			if !conf.HideQR {
+				showQR(upload)
+			}
+			fmt.Fprintln(output, link(upload))
+		}
+
+		if conf.QRPage {
+			name := ""
+			if conf.sending() {
+				name = conf.FileName
+			}
+			mux.HandleFunc("/qr", qrPage(tpl, name, url))
+			fmt.Fprintf(output, "printable QR code at %v\n", link("http://"+host+"/qr"))
+		}
+		if conf.Preview {
+			fmt.Fprintf(output, "preview at %v\n", link("http://"+host+conf.previewPath()))
+		}
+		if conf.Checksum {
+			fmt.Fprintf(output, "checksum at %v\n", link("http://"+host+conf.checksumPath()))
+		}
+	}
+
+	if conf.DryRun {
+		fmt.Fprintln(output, "all good, but this is a dry run so nothing's being served")
+		return
+	}
+
+	// Shut down gracefully on Ctrl+C so an in-progress upload isn't cut off
+	// halfway through being written to disk.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Fprintln(output, "shutting down... (press Ctrl+C again to quit now)")
+		go shutdown(server, conf.Grace)
+
+		// Without a grace period a stalled client could hold us up forever, so
+		// give the user a way out.
+		<-sig
+		os.Exit(1)
+	}()
+
+	if conf.Wait {
+		fmt.Fprintln(output, "press Enter to stop serving")
+	}
+	if conf.Controls {
+		fmt.Fprintln(output, "type a and press Enter to abort transfers in progress, or q to quit")
+	}
+	if conf.Wait || conf.Controls {
+		go readCommands(server, conf)
+	}
+
+	if conf.Open && url != "" {
+		go func() {
+			err := openBrowser(url)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: could not open browser: %v\n", err)
+			}
+		}()
+	}
+
+	logger.Info("start", "addr", ln.Addr().String(), "url", url)
+	err = server.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "server exited with error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Wait for the server to finish any transfers, up to the grace period.
+	if conf.Grace > 0 {
+		select {
+		case <-done:
+		case <-time.After(conf.Grace):
+		}
+	} else {
+		<-done
+	}
+}
+
+// setupDuplex sets up the HTTP server for -duplex, sending a file and taking
+// uploads at the same time. The upload side is everything -upload would be,
+// moved under /upload, and it's only once both sides are done that RUFF
+// shuts down.
+func setupDuplex(mux *http.ServeMux, server *http.Server, conf Config, tpl *template.Template) {
+	setupDownload(mux, server, conf, tpl)
+	uploads := http.NewServeMux()
+	setupUpload(uploads, server, conf, tpl)
+	sidesLeft.Store(1)
+
+	// The upload side thinks it's at /, so it gets the path without /upload.
+	prefix := strings.TrimSuffix(conf.UploadPath(), "/")
+	strip := func(w http.ResponseWriter, r *http.Request) {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		r2.URL.RawPath = ""
+		uploads.ServeHTTP(w, r2)
+	}
+	mux.HandleFunc(prefix, strip)
+	mux.HandleFunc(prefix+"/", strip)
+}
+
+// setupDownload sets up the HTTP server for sending a file to a remote device.
+func setupDownload(mux *http.ServeMux, server *http.Server, conf Config, tpl *template.Template) {
+	filePath := conf.sharePath()
+
+	// notFound points anyone who fumbled the URL at the file they were after,
+	// unless the path's meant to be a secret.
+	notFound := func(w http.ResponseWriter, r *http.Request) {
+		page := struct{ Name, Link string }{conf.FileName, filePath}
+		if conf.Secret || len(conf.Tokens) > 0 {
+			page.Link = ""
+		}
+		w.WriteHeader(http.StatusNotFound)
+		tpl.ExecuteTemplate(w, "NotFound", page)
+	}
+
+	// stop wraps up sending, however it comes to an end.
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() { finished(server, conf) })
+	}
+
+	// gone lets people down gently when the file's been deleted or moved out
+	// from under us, then shuts down since there's nothing left to serve.
+	var goneOnce sync.Once
+	gone := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+		tpl.ExecuteTemplate(w, "FileGone", conf.FileName)
+		goneOnce.Do(func() {
+			logger.Warn("file is gone", "path", conf.FilePath)
+			fmt.Fprintf(os.Stderr, "%v has gone missing, shutting down\n", conf.FilePath)
+			go stop()
+		})
+	}
+
+	// landing tells people what they're about to get before the browser asks
+	// where to save it. Only the file itself counts as a download.
+	landing := func(w http.ResponseWriter, r *http.Request) {
+		size, err := fileSize(conf)
+		if errors.Is(err, fs.ErrNotExist) {
+			gone(w, r)
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			http.Error(w, "could not find the file", http.StatusInternalServerError)
+			return
+		}
+		page := struct{ Name, Size, Link, Banner string }{conf.FileName, size, filePath, conf.Banner}
+		err = tpl.ExecuteTemplate(w, "Landing", page)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if filePath != "/" || len(conf.Tokens) > 0 {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			// Redirecting would hand the secret out to anyone who asked.
+			if r.URL.Path != "/" || conf.Secret || len(conf.Tokens) > 0 {
+				notFound(w, r)
+				return
+			}
+			if conf.Landing {
+				landing(w, r)
+				return
+			}
+			// 303 redirect to real file.
+			http.RedirectHandler(filePath, http.StatusSeeOther).ServeHTTP(w, r)
+		})
+	}
+
+	// Browsers ask for a favicon whether we have one or not. Nip that in the
+	// bud so it doesn't end up tangled with the file.
+	if filePath != "/favicon.ico" {
+		mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+
+	// With -per-ip, -count is each device's allowance and -total is the cap
+	// across every device that brings the server down.
+	var mu sync.Mutex
+	downloads := conf.Downloads
+	if conf.PerIP {
+		downloads = conf.Total
+	}
+	// With -tokens there's a download for each link, and the links keep track
+	// of which is which.
+	links := make(map[string]*linkState)
+	for _, path := range conf.linkPaths() {
+		links[path] = new(linkState)
+	}
+	if len(links) > 0 {
+		downloads = len(links)
+	}
+	limited := downloads > 0
+	perIP := make(map[string]int)
+	playing := make(streams)
+	resuming := make(resumes)
+
+	// Scripts and pages can size up the file before fetching it, without it
+	// counting as a download.
+	meta := func(w http.ResponseWriter, r *http.Request) {
+		meta, err := getFileMeta(conf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			writeJSON(w, http.StatusInternalServerError, jsonError{err.Error()})
+			return
+		}
+		meta.Remaining = -1
+		if limited {
+			mu.Lock()
+			meta.Remaining = downloads
+			mu.Unlock()
+		}
+		writeJSON(w, http.StatusOK, meta)
+	}
+	if conf.JSON && !conf.Archive && !conf.Relay {
+		mux.HandleFunc("/meta", meta)
+	}
+	switch {
+	case conf.Archive, conf.Relay:
+	case conf.Secret:
+		mux.HandleFunc("/"+conf.Token+"/meta.json", meta)
+	default:
+		mux.HandleFunc("/meta.json", meta)
+	}
+
+	// Nor does its checksum, which is handy for checking the download made it
+	// in one piece.
+	if conf.Checksum {
+		mux.HandleFunc(conf.checksumPath(), func(w http.ResponseWriter, r *http.Request) {
+			meta, err := getFileMeta(conf)
+			if errors.Is(err, fs.ErrNotExist) {
+				gone(w, r)
+				return
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				http.Error(w, "could not hash the file", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Disposition", attachment(conf.FileName+".sha256"))
+			// The same format as sha256sum, two spaces and all.
+			fmt.Fprintf(w, "%v  %v\n", meta.SHA256, conf.FileName)
+		})
+	}
+
+	// A look at the file doesn't count as a download either.
+	if conf.Preview {
+		mux.HandleFunc(conf.previewPath(), func(w http.ResponseWriter, r *http.Request) {
+			err := servePreview(w, r, conf, tpl, filePath)
+			if errors.Is(err, fs.ErrNotExist) {
+				gone(w, r)
+			} else if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				http.Error(w, "could not preview the file", http.StatusInternalServerError)
+			}
+		})
+	}
+
+	// -alias serves the file from a second path, sharing its downloads.
+	aliasPath := ""
+	if conf.Alias != "" {
+		aliasPath = "/" + conf.Alias
+	}
+
+	download := func(w http.ResponseWriter, r *http.Request) {
+		// Served from / this handler catches everything, so don't let a stray
+		// request for something else count as a download.
+		link := links[r.URL.Path]
+		if len(links) > 0 && link == nil || len(links) == 0 && r.URL.Path != filePath && r.URL.Path != aliasPath {
+			notFound(w, r)
+			return
+		}
+		// A one-time link is good for the whole file once, not a bit at a
+		// time.
+		if link != nil {
+			r.Header.Del("Range")
+		}
+
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		var info os.FileInfo
+		var err error
+		if !conf.Relay {
+			info, err = os.Stat(conf.FilePath)
+			if errors.Is(err, fs.ErrNotExist) {
+				gone(w, r)
+				return
+			}
+		}
+		// Only the file as it is can be picked up partway, not an archive, a
+		// URL, or the file gzipped on the fly.
+		gzipped := conf.Gzip && compressible(conf.FileName) && acceptsGzip(r)
+		// Whether it's gzipped or not comes down to Accept-Encoding, so caches
+		// need to know that either way, not just when it is.
+		if conf.Gzip && compressible(conf.FileName) {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		etag := ""
+		if err == nil && !conf.Archive && !conf.Relay && !gzipped {
+			etag = fileETag(info)
+		}
+
+		// Claim the download in the same breath as checking there's one left,
+		// so devices racing each other can't all slip through. It's handed back
+		// below if the file doesn't end up going out. HEAD never sends the
+		// file, so it doesn't claim anything.
+		ip := clientIP(r)
+		claim := r.Method != http.MethodHead
+		ranged := r.Method == http.MethodGet && r.Header.Get("Range") != ""
+		free := false
+		resumed := false
+		last := false
+		mu.Lock()
+		left, ok := perIP[ip]
+		if !ok {
+			left = conf.Downloads
+		}
+		switch {
+		case link != nil && *link == linkUsed:
+			mu.Unlock()
+			logger.Info("link already used", "remote", ip)
+			w.WriteHeader(http.StatusGone)
+			tpl.ExecuteTemplate(w, "FileGone", conf.FileName)
+			return
+		case link != nil && *link == linkInUse:
+			mu.Unlock()
+			http.Error(w, "this link is already being downloaded", http.StatusConflict)
+			return
+		// Seeking around a stream that's already been counted is on the house,
+		// even if that was the last download. See streams for the details.
+		case ranged && playing.watching(ip, time.Now()):
+			playing.begin(ip)
+			claim, free = false, true
+		// So is picking up a download that got cut off. See resumes.
+		case ranged && etag != "" && resuming.pending(ip, etag, time.Now()):
+			claim, resumed = false, true
+		// -count 0 leaves each device unlimited, same as it does overall.
+		case conf.PerIP && conf.Downloads > 0 && left == 0:
+			mu.Unlock()
+			logger.Info("no downloads left", "remote", ip)
+			http.Error(w, "this device has already used up its downloads", http.StatusForbidden)
+			return
+		case limited && downloads == 0:
+			mu.Unlock()
+			http.Error(w, "there are no downloads left", http.StatusGone)
+			return
+		case claim:
+			if conf.PerIP {
+				perIP[ip] = left - 1
+			}
+			if link != nil {
+				*link = linkInUse
+			}
+			downloads--
+			last = downloads == 0
+		}
+		mu.Unlock()
+
+		w.Header().Set("Content-Disposition", attachment(conf.FileName))
+		// Going by the extension (or what we were told) beats ServeFile sniffing
+		// the first 512 bytes, which tends to guess wrong for media. If neither
+		// knows, leave it to the sniffing.
+		if ctype := fileType(conf); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+
+		// http.ServeContent handles all the nitty gritty details of hauling the
+		// file off, ranges and all. How ranges count towards -count is down to
+		// streams above.
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		// broken is set if packing up an archive went wrong on our end, rather
+		// than the client going away.
+		broken := false
+		switch {
+		case conf.Archive:
+			err := serveArchive(sw, r, conf.FilePath)
+			if err != nil && sw.err == nil {
+				broken = true
+				logger.Error("archive failed", "path", conf.FilePath, "err", err)
+				fmt.Fprintln(os.Stderr, err)
+			}
+		case conf.Relay:
+			err := serveRelay(sw, r, conf)
+			if err != nil && sw.err == nil {
+				broken = true
+				logger.Error("relay failed", "url", conf.FilePath, "err", err)
+				fmt.Fprintln(os.Stderr, err)
+			}
+		case gzipped:
+			serveGzip(sw, r, conf.FilePath)
+		default:
+			serveFile(sw, r, conf)
+		}
+
+		// With -delete-after only a download that sent the whole file counts,
+		// so part of it doesn't start a stream or use up a download, see below.
+		partial := sw.status == http.StatusPartialContent && conf.DeleteAfter
+		if ranged && (free || claim && sw.status == http.StatusPartialContent && !partial) {
+			mu.Lock()
+			playing.end(ip, time.Now(), claim)
+			mu.Unlock()
+		}
+
+		if resumed {
+			mu.Lock()
+			switch {
+			case sw.err == nil && reachesEnd(sw.status, w.Header()):
+				resuming.finished(ip, etag)
+				logger.Info("download resumed", "remote", ip, "status", sw.status)
+			case sw.err != nil && !stalled(sw.err):
+				resuming.interrupted(ip, etag, time.Now())
+			}
+			mu.Unlock()
+		}
+
+		// Browsers like to poke at a file with a conditional GET before fetching
+		// it for real. Only count requests that actually sent the file.
+		if !claim {
+			return
+		}
+		// With -delete-after a download that gets cut off partway, or only asked
+		// for part of the file, doesn't count either, so the file's never
+		// deleted before anybody has it. A
+		// client that stalled is as good as gone, so it doesn't get to use up
+		// a download regardless, and neither does a broken archive or relay,
+		// since that's on us. Nor does it use up a one-time link.
+		if sw.status < 200 || sw.status > 299 || partial || (conf.DeleteAfter || link != nil) && sw.err != nil || stalled(sw.err) || broken {
+			if stalled(sw.err) {
+				logger.Info("download stalled", "remote", ip)
+			}
+			mu.Lock()
+			if conf.PerIP {
+				perIP[ip]++
+			}
+			if link != nil {
+				*link = linkFree
+			}
+			downloads++
+			mu.Unlock()
+			return
+		}
+		if link != nil {
+			mu.Lock()
+			*link = linkUsed
+			mu.Unlock()
+		}
+
+		// A download that was cut off still counts, but the device gets a
+		// chance to come back for the rest.
+		if sw.err != nil && etag != "" {
+			mu.Lock()
+			resuming.interrupted(ip, etag, time.Now())
+			mu.Unlock()
+		}
+
+		downloadsServed.Add(1)
+		logger.Info("download complete", "remote", ip, "status", sw.status)
+		if conf.Webhook != "" {
+			notify(conf.Webhook, transferEvent{"download", conf.FileName, ip, sw.sent})
+		}
+		if conf.State != "" {
+			mu.Lock()
+			err := saveState(conf.State, downloads)
+			mu.Unlock()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		if last && conf.DeleteAfter {
+			deleteFile(conf.FilePath)
+		}
+		if last && (ranged || sw.err != nil) {
+			// Let the stream play out, or give the download a chance to be
+			// resumed, before pulling the plug. A resume can finish well before
+			// it has to, so check back every so often.
+			go func() {
+				for {
+					mu.Lock()
+					now := time.Now()
+					wait := max(playing.idleIn(ip, now), resuming.idleIn(ip, etag, now))
+					mu.Unlock()
+					if wait == 0 {
+						break
+					}
+					time.Sleep(min(wait, time.Second))
+				}
+				stop()
+			}()
+		} else if last {
+			go stop()
+		}
+	}
+	if len(links) > 0 {
+		for path := range links {
+			mux.HandleFunc(path, download)
+		}
+	} else {
+		mux.HandleFunc(filePath, download)
+	}
+	if aliasPath != "" {
+		mux.HandleFunc(aliasPath, download)
+	}
+}
+
+// serveFile sends the file, answering range and conditional requests along
+// the way.
+func serveFile(w http.ResponseWriter, r *http.Request, conf Config) {
+	f, err := os.Open(conf.FilePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		http.Error(w, "could not open file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		http.Error(w, "could not open file", http.StatusInternalServerError)
+		return
+	}
+
+	// ServeContent answers If-None-Match itself as long as there's an ETag to
+	// compare against. A 304 sends nothing, so it isn't counted.
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeContent(w, r, conf.FileName, info.ModTime(), f)
+}
+
+// fileType is the content type to send the file as, going by -content-type
+// or else the extension. It's empty if neither knows.
+func fileType(conf Config) string {
+	if conf.ContentType != "" {
+		return conf.ContentType
+	}
+	return mime.TypeByExtension(filepath.Ext(conf.FileName))
+}
+
+// attachment is the Content-Disposition header that has a download saved as
+// name. filename only really takes ASCII, so a name that doesn't fit in it
+// gets a stand-in there, with accents dropped and anything else replaced by
+// _, and the real thing in filename* for browsers that know RFC 5987, which
+// is all of them these days.
+func attachment(name string) string {
+	var fallback strings.Builder
+	exact := true
+	for _, r := range norm.NFD.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			exact = false
+		case r == '"' || r == '\\':
+			fallback.WriteRune('\\')
+			fallback.WriteRune(r)
+		case r < ' ' || r > '~':
+			fallback.WriteRune('_')
+			exact = false
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	if exact {
+		// Decomposing the name doesn't change a thing if it's all ASCII.
+		return `attachment; filename="` + fallback.String() + `"`
+	}
+
+	var encoded strings.Builder
+	for _, b := range []byte(name) {
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&encoded, "%%%02X", b)
+	}
+	return `attachment; filename="` + fallback.String() + `"; filename*=UTF-8''` + encoded.String()
+}
+
+// fileSize describes how big the file being sent is, for people to see before
+// they download it.
+func fileSize(conf Config) (string, error) {
+	// There's no asking upstream without fetching the file.
+	if conf.Relay {
+		return "size unknown", nil
+	}
+	info, err := os.Stat(conf.FilePath)
+	if err != nil {
+		return "", err
+	}
+	if !conf.Archive {
+		return humanSize(info.Size()), nil
+	}
+	_, total, err := dirSize(conf.FilePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return humanSize(total) + " before compressing", nil
+}
+
+// statusWriter wraps a ResponseWriter to remember the status code that was
+// sent.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	// err is set if the response didn't all make it out, usually because the
+	// other end went away or stalled.
+	err error
+	// sent is how much of the body made it out.
+	sent int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.sent += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// ReadFrom lets io.Copy reach the underlying writer's ReadFrom, which keeps
+// sendfile in play for big files.
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.sent += n
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// deleteFile removes the file for -delete-after.
+func deleteFile(name string) {
+	err := os.Remove(name)
+	if err != nil {
+		logger.Error("could not delete file", "path", name, "err", err)
+		fmt.Fprintf(os.Stderr, "could not delete %v: %v\n", name, err)
+		return
+	}
+	logger.Info("file deleted", "path", name)
+	fmt.Fprintf(output, "deleted %v\n", name)
+}
+
+// clientIP returns the address of the device that sent a request, minus the
+// port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedIP returns the client's address as passed along by a reverse
+// proxy, or an empty string if there isn't one. X-Forwarded-For can pile up
+// through several hops, and only the last one was added by our proxy, so
+// that's the one we trust.
+func forwardedIP(r *http.Request) string {
+	ip := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if ip == "" {
+		hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		ip = strings.TrimSpace(hops[len(hops)-1])
+	}
+	if net.ParseIP(ip) == nil {
+		return ""
+	}
+	return ip
+}
+
+// trustProxy wraps a handler so requests appear to come from wherever the
+// reverse proxy in front of us says they came from. Anybody can set these
+// headers, so this is only safe when RUFF isn't directly reachable.
+func trustProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := forwardedIP(r); ip != "" {
+			r.RemoteAddr = ip
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxTextQR is the longest text that will be put directly into a QR code
+// before it gets too big to fit comfortably in a terminal.
+const maxTextQR = 160
+
+// setupText sets up the HTTP server for sharing a snippet of text with a
+// remote device. Each view of the page counts as a download.
+func setupText(mux *http.ServeMux, server *http.Server, conf Config, tpl *template.Template) {
+	var mu sync.Mutex
+	views := conf.Downloads
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
 
-	downloads := conf.Downloads
-	http.HandleFunc("/"+conf.FileName, func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("Incoming request: %v: %v %v %v\n", r.RemoteAddr, r.Proto, r.Method, r.URL)
+		err := tpl.ExecuteTemplate(w, "TextMessage", conf.Text)
+		if err != nil {
+			panic(err)
+		}
 
-		w.Header().Set("Content-Disposition", "attachment; filename=\""+url.PathEscape(conf.FileName)+"\"")
-		// http.ServeFile handles all the nitty gritty details of hauling the file
-		// off, but maybe it shouldn't? ServeFile does content ranges and I really
-		// don't see that working with limited download counts unless we reimplement
-		// all that logic ourselves.
-		http.ServeFile(w, r, conf.FilePath)
+		// A HEAD request never gets to see the text, so it doesn't count.
+		if r.Method == http.MethodHead {
+			return
+		}
 
-		downloads--
-		if downloads == 0 {
-			go shutdown(server)
+		downloadsServed.Add(1)
+		logger.Info("text viewed", "remote", clientIP(r))
+		mu.Lock()
+		views--
+		last := views == 0
+		mu.Unlock()
+		if last {
+			go finished(server, conf)
 		}
 	})
 }
@@ -189,9 +2101,83 @@ var baseHeader = `<!DOCTYPE html>
 				display: inline-block;
 				text-align: left;
 			}
-			input {
+			input, button, textarea {
 				font: inherit;
 			}
+			textarea {
+				width: 100%;
+			}
+			#dropzone, #pastezone {
+				margin-top: 12pt;
+				padding: 24pt;
+				border: 2pt dashed #9e9e9e;
+				text-align: center;
+			}
+			#dropzone.over {
+				border-color: #212121;
+				background: #eeeeee;
+			}
+			progress {
+				width: 100%;
+				margin-top: 12pt;
+			}
+			table {
+				margin: 0 auto;
+				border-collapse: collapse;
+				text-align: left;
+			}
+			th, td {
+				padding: 4pt 12pt;
+				border-bottom: 1pt solid #9e9e9e;
+			}
+			pre.preview {
+				display: inline-block;
+				max-width: 100%;
+				padding: 12pt;
+				border: 1pt solid #9e9e9e;
+				text-align: left;
+				font-size: 12pt;
+				white-space: pre-wrap;
+				word-break: break-word;
+			}
+			img.preview {
+				max-width: 100%;
+			}
+			.hash {
+				font-size: 10pt;
+				word-break: break-all;
+			}
+			.card {
+				display: inline-block;
+				padding: 12pt 24pt;
+				border: 1pt dashed #9e9e9e;
+				word-break: break-all;
+			}
+			.qr svg {
+				width: 6cm;
+				height: 6cm;
+			}
+			@media print {
+				body {
+					padding: 0;
+				}
+			}
+			#banner {
+				padding: 8pt 12pt;
+				border: 1pt solid #9e9e9e;
+				background: #eeeeee;
+			}
+			#logo {
+				max-width: 100%;
+				max-height: 120pt;
+			}
+			.button {
+				display: inline-block;
+				padding: 12pt 24pt;
+				border: 2pt solid #212121;
+				color: inherit;
+				text-decoration: none;
+			}
 		</style>
 	</head>
 	<body>`
@@ -199,40 +2185,424 @@ var baseHeader = `<!DOCTYPE html>
 var baseFooter = `</body>
 </html>`
 
-var uploadTemplate = `{{template "BaseHeader" "RUFF - Upload Form"}}
-		<form enctype="multipart/form-data" action="/" method="post">
+var uploadTemplate = `{{template "BaseHeader" (or .Title "RUFF - Upload Form")}}
+		{{with .Banner}}<p id="banner">{{.}}</p>{{end}}
+		{{with .LogoURL}}<img id="logo" src="{{.}}" alt=""><br>{{end}}
+		{{with .Title}}<h1>{{.}}</h1>{{end}}
+		<form id="upload" enctype="multipart/form-data" action="{{.UploadPath}}" method="post">
 			<label for="file">Select a file for upload:</label><br><br>
-			<input type="file" name="file"{{if .Multiple}} multiple{{end}}>
+			<input type="file" id="file" name="{{.FieldName}}"{{if .Multiple}} multiple{{end}}{{if .KeepStructure}} webkitdirectory{{end}}{{with .AcceptList}} accept="{{.}}"{{end}}>
 			<input type="submit" value="Upload">
+			<div id="dropzone" hidden>or drop {{if .Multiple}}files{{else}}a file{{end}} here</div>
+			<div id="pastezone" contenteditable inputmode="none" hidden>or tap here and paste an image</div>
+			<img id="pasted" class="preview" alt="" hidden>
+			<progress id="progress" max="100" value="0" hidden></progress>
+			<div id="status"></div>
 		</form>
+		<script>
+			// The drop zone and progress bar are hidden until we know JS is around to
+			// drive them. Without JS the form just submits the old fashioned way.
+			(function() {
+				var form = document.getElementById("upload");
+				var input = document.getElementById("file");
+				var zone = document.getElementById("dropzone");
+				var progress = document.getElementById("progress");
+				var status = document.getElementById("status");
+				var multiple = {{.Multiple}};
+				zone.hidden = false;
+
+				function send(files) {
+					if (files.length === 0) {
+						return;
+					}
+					if (!multiple && files.length > 1) {
+						status.textContent = "Only one file can be uploaded at a time.";
+						return;
+					}
+
+					var data = new FormData();
+					for (var i = 0; i < files.length; i++) {
+						// Keep the path within the folder for -keep-structure.
+						data.append({{.FieldName}}, files[i], files[i].webkitRelativePath || files[i].name);
+					}
+
+					// fetch can't report upload progress, so it's XHR for this one.
+					var xhr = new XMLHttpRequest();
+					xhr.upload.onprogress = function(e) {
+						if (e.lengthComputable) {
+							progress.value = 100 * e.loaded / e.total;
+							status.textContent = Math.floor(progress.value) + "%";
+						}
+					};
+					xhr.onload = function() {
+						// Swap in the server's response page in place of the form.
+						var page = new DOMParser().parseFromString(xhr.responseText, "text/html");
+						document.title = page.title;
+						document.body.innerHTML = page.body.innerHTML;
+					};
+					xhr.onerror = function() {
+						progress.hidden = true;
+						status.textContent = "Upload failed, the connection was lost.";
+					};
+
+					progress.value = 0;
+					progress.hidden = false;
+					status.textContent = "Uploading...";
+					xhr.open("POST", {{.UploadPath}});
+					xhr.setRequestHeader("Accept", "text/html");
+					xhr.send(data);
+				}
+
+				form.addEventListener("submit", function(e) {
+					e.preventDefault();
+					send(input.files);
+				});
+				zone.addEventListener("dragover", function(e) {
+					e.preventDefault();
+					zone.classList.add("over");
+				});
+				zone.addEventListener("dragleave", function() {
+					zone.classList.remove("over");
+				});
+				zone.addEventListener("drop", function(e) {
+					e.preventDefault();
+					zone.classList.remove("over");
+					send(e.dataTransfer.files);
+				});
+
+				// A screenshot can be pasted in anywhere on the page. Phones only
+				// offer to paste into something editable, hence the paste zone,
+				// but nothing actually gets typed into it.
+				var paste = document.getElementById("pastezone");
+				var pasted = document.getElementById("pasted");
+				paste.hidden = false;
+				paste.addEventListener("beforeinput", function(e) {
+					e.preventDefault();
+				});
+				document.addEventListener("paste", function(e) {
+					var items = e.clipboardData ? e.clipboardData.items : [];
+					for (var i = 0; i < items.length; i++) {
+						if (items[i].kind !== "file" || items[i].type.indexOf("image/") !== 0) {
+							continue;
+						}
+						e.preventDefault();
+
+						// Pasted images don't come with a name, so give them one.
+						var image = items[i].getAsFile();
+						var stamp = new Date().toISOString().replace(/[-:]/g, "").replace("T", "-").slice(0, 15);
+						var ext = image.type.slice(6).replace("jpeg", "jpg").replace(/\+.*/, "");
+						var file = new File([image], "pasted-" + stamp + "." + ext, {type: image.type});
+						pasted.src = URL.createObjectURL(file);
+						pasted.hidden = false;
+						send([file]);
+						return;
+					}
+				});
+			})();
+		</script>
 {{template "BaseFooter"}}`
 
 var errorTemplate = `{{template "BaseHeader" "RUFF - Upload Error"}}
 		<p>{{.}}</p>
-		<p><a href="/">Go back</a></p>
+		<p><a href="">Go back</a></p>
 {{template "BaseFooter"}}`
 
-var messageTemplate = `{{template "BaseHeader" (print "RUFF - " .)}}
-		<p>{{.}}</p>
+var landingTemplate = `{{template "BaseHeader" (print "RUFF - " .Name)}}
+		{{with .Banner}}<p id="banner">{{.}}</p>{{end}}
+		<p>Somebody's sending you a file:</p>
+		<p><b>{{.Name}}</b> ({{.Size}})</p>
+		<p><a class="button" href="{{.Link}}" download>Download</a></p>
 {{template "BaseFooter"}}`
 
-// setupUpload sets up the HTTP server for receiving a file from another device
-// through an upload form and a small stack of templates.
+var previewTemplate = `{{template "BaseHeader" (print "RUFF - " .Name)}}
+		<p><b>{{.Name}}</b> ({{.Size}})</p>
+		{{- if eq .Kind "text"}}
+		<pre class="preview">{{.Text}}</pre>
+		{{- else if eq .Kind "image"}}
+		<p><img class="preview" src="?raw" alt="{{.Name}}"></p>
+		{{- else}}
+		<p>This file can't be previewed{{if .TooBig}}, it's too big{{end}}.</p>
+		{{- end}}
+		<p><a class="button" href="{{.Link}}" download>Download</a></p>
+{{template "BaseFooter"}}`
+
+var qrPageTemplate = `{{template "BaseHeader" (print "RUFF - " (or .Name "QR Code"))}}
+		<div class="card">
+			{{- if .Name}}
+			<p><b>{{.Name}}</b></p>
+			{{- end}}
+			<div class="qr">{{.QR}}</div>
+			<p>{{.URL}}</p>
+		</div>
+{{template "BaseFooter"}}`
+
+var goneTemplate = `{{template "BaseHeader" "RUFF - File Gone"}}
+		<p>Sorry, {{.}} isn't available anymore.</p>
+		<p>Ask whoever sent it to share it again.</p>
+{{template "BaseFooter"}}`
+
+var endedTemplate = `{{template "BaseHeader" "RUFF - Transfer Ended"}}
+		<p>Sorry, you just missed it. This transfer has ended.</p>
+		<p>Ask whoever shared it to start it up again.</p>
+{{template "BaseFooter"}}`
+
+var notFoundTemplate = `{{template "BaseHeader" "RUFF - Not Found"}}
+		<p>There's nothing here.</p>
+		{{- if .Link}}
+		<p>Looking for <a href="{{.Link}}">{{.Name}}</a>?</p>
+		{{- end}}
+{{template "BaseFooter"}}`
+
+var messageTemplate = `{{template "BaseHeader" (print "RUFF - " .Message)}}
+		<p>{{.Message}}</p>
+		{{- if .Files}}
+		<table>
+			<tr><th>File</th><th>Size</th><th>SHA-256</th></tr>
+			{{- range .Files}}
+			<tr><td>{{if .URL}}<a href="{{.URL}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}{{with .Duplicate}} (duplicate of {{.}}){{end}}</td><td>{{.HumanSize}}</td><td class="hash">{{.SHA256}}</td></tr>
+			{{- end}}
+		</table>
+		{{- end}}
+{{template "BaseFooter"}}`
+
+var textTemplate = `{{template "BaseHeader" "RUFF - Shared Text"}}
+		<textarea id="text" rows="10" readonly>{{.}}</textarea><br><br>
+		<button id="copy" hidden>Copy to clipboard</button>
+		<script>
+			(function() {
+				var text = document.getElementById("text");
+				var copy = document.getElementById("copy");
+				copy.hidden = false;
+				copy.addEventListener("click", function() {
+					// The clipboard API is only around on secure origins, which a
+					// plain HTTP LAN address isn't, so fall back to the old way.
+					if (navigator.clipboard && window.isSecureContext) {
+						navigator.clipboard.writeText(text.value);
+					} else {
+						text.select();
+						document.execCommand("copy");
+					}
+					copy.textContent = "Copied!";
+				});
+			})();
+		</script>
+{{template "BaseFooter"}}`
+
+// loadTemplates parses the small stack of built-in templates, then lets any
+// *.html files in dir replace them by defining templates of the same name.
+// Anything dir doesn't define keeps its built-in version.
 //
 // When go1.16 gets more widespread maybe I'll hack the templates off into
 // their own files.
-func setupUpload(server *http.Server, conf Config) {
+func loadTemplates(dir string) (*template.Template, error) {
 	tpl := template.Must(template.New("BaseHeader").Parse(baseHeader))
 	template.Must(tpl.New("BaseFooter").Parse(baseFooter))
 	template.Must(tpl.New("UploadForm").Parse(uploadTemplate))
 	template.Must(tpl.New("UploadError").Parse(errorTemplate))
 	template.Must(tpl.New("UploadMessage").Parse(messageTemplate))
+	template.Must(tpl.New("TextMessage").Parse(textTemplate))
+	template.Must(tpl.New("NotFound").Parse(notFoundTemplate))
+	template.Must(tpl.New("FileGone").Parse(goneTemplate))
+	template.Must(tpl.New("Ended").Parse(endedTemplate))
+	template.Must(tpl.New("Landing").Parse(landingTemplate))
+	template.Must(tpl.New("Preview").Parse(previewTemplate))
+	template.Must(tpl.New("QRPage").Parse(qrPageTemplate))
+
+	if dir == "" {
+		return tpl, nil
+	}
+
+	_, err := tpl.ParseGlob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, fmt.Errorf("could not load templates from %v: %w", dir, err)
+	}
+
+	return tpl, nil
+}
+
+// setupUpload sets up the HTTP server for receiving a file from another device
+// through an upload form.
+func setupUpload(mux *http.ServeMux, server *http.Server, conf Config, tpl *template.Template) {
+	// fail reports an upload error back to the client, as JSON or plain text if
+	// that's what they're expecting.
+	fail := func(w http.ResponseWriter, r *http.Request, status int, err error) {
+		fmt.Fprintln(os.Stderr, err)
+		if conf.JSON {
+			writeJSON(w, status, jsonError{err.Error()})
+			return
+		}
+		if wantsText(r) {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(status)
+		tpl.ExecuteTemplate(w, "UploadError", err)
+	}
+
+	tooLarge := fmt.Errorf("upload is too large, the limit is %v", &conf.MaxSize)
+
+	// With -reshare, uploaded files are kept on offer by their name relative
+	// to the upload directory. -verify does the same, but only until it's
+	// time to go.
+	serveBack := conf.Reshare || conf.Verify > 0
+	var mu sync.Mutex
+	reshared := make(map[string]string)
+	reshare := func(r *http.Request, saved *savedFile) {
+		if !serveBack {
+			return
+		}
+		file := saved.Name
+		if saved.Duplicate != "" {
+			file = saved.Duplicate
+		}
+		name := filepath.ToSlash(file)
+		mu.Lock()
+		reshared[name] = file
+		mu.Unlock()
+		saved.URL = (&url.URL{Scheme: "http", Host: r.Host, Path: conf.UploadPath() + name}).String()
+	}
+
+	// dupes checks a saved upload against what's already there for -dedup.
+	var dupes *dedup
+	if conf.Dedup {
+		dupes = newDedup()
+	}
+	dedupe := func(saved *savedFile) error {
+		if dupes == nil {
+			return nil
+		}
+		return dupes.check(saved)
+	}
+
+	// dated puts an already cleaned up name under today's directory when
+	// -subdir-by-date asks for it.
+	dated := func(name string) string {
+		if !conf.DateDirs {
+			return name
+		}
+		return filepath.Join(time.Now().Format("2006-01-02"), name)
+	}
+
+	// saveBody saves a request body as-is under the given name, reporting any
+	// trouble to the client itself. ok is false if the file wasn't saved.
+	saveBody := func(w http.ResponseWriter, r *http.Request, name string) (saved savedFile, ok bool) {
+		if !accepted(conf.Accept, name) {
+			fail(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("files of type %q are not accepted, allowed types are: %v", filepath.Ext(name), strings.Join(conf.Accept, " ")))
+			return saved, false
+		}
+
+		name = dated(name)
+		saved, err := writeFile(name, r.Body, conf.GzipUploads)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			fail(w, r, http.StatusRequestEntityTooLarge, tooLarge)
+			return saved, false
+		}
+		var badErr badEncoding
+		if errors.As(err, &badErr) {
+			fail(w, r, http.StatusBadRequest, badErr)
+			return saved, false
+		}
+		if err == nil {
+			err = dedupe(&saved)
+		}
+		if err != nil {
+			fail(w, r, http.StatusInternalServerError, fmt.Errorf("could not save file %v: %w", name, err))
+			return saved, false
+		}
+		reshare(r, &saved)
+		return saved, true
+	}
+
+	if conf.Logo != "" && !logoIsURL(conf.Logo) {
+		mux.HandleFunc("/logo", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, conf.Logo)
+		})
+	}
+
+	// Anyone following /progress hears about each upload as it comes in.
+	var feed *progressFeed
+	if conf.Progress {
+		feed = newProgressFeed()
+		server.RegisterOnShutdown(feed.close)
+		mux.HandleFunc("/progress", feed.serve)
+	}
+
+	// With -to-stdout only one upload can be writing at a time.
+	streaming := false
+
+	// finish wraps things up after a successful upload, shutting down once
+	// -uploads have come in. With -verify, the uploads are closed then, but
+	// the files stay up to be checked for a while first.
+	uploads := conf.Uploads
+	closed := false
+	finish := func(r *http.Request, files ...savedFile) {
+		uploadsReceived.Add(1)
+		logger.Info("upload complete", "remote", clientIP(r))
+		if conf.Webhook != "" {
+			for _, file := range files {
+				notify(conf.Webhook, transferEvent{"upload", file.Name, clientIP(r), file.Size})
+			}
+		}
+		mu.Lock()
+		uploads--
+		last := uploads == 0
+		// An upload that was already going when the last one came in can
+		// still finish, but that doesn't open things back up.
+		if last && conf.Verify > 0 {
+			closed = true
+		}
+		mu.Unlock()
+		switch {
+		case last && conf.Verify > 0:
+			fmt.Fprintf(output, "all uploads are in, serving them back for %v so they can be checked. press Ctrl+C to quit sooner\n", conf.Verify)
+			logger.Info("verifying", "for", conf.Verify.String())
+			go func() {
+				time.Sleep(conf.Verify)
+				finished(server, conf)
+			}()
+		case last && !conf.Reshare:
+			go finished(server, conf)
+		}
+	}
+	// full reports whether uploads have closed for -verify.
+	full := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return closed
+	}
+
+	// tus clients get their own endpoint to resume uploads from.
+	if conf.Tus {
+		tus := newTusServer(conf, dated, func(r *http.Request, saved *savedFile) error {
+			if err := dedupe(saved); err != nil {
+				return err
+			}
+			reshare(r, saved)
+			finish(r, *saved)
+			return nil
+		})
+		tus.full = full
+		server.RegisterOnShutdown(tus.close)
+		mux.Handle("/tus/", tus)
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("Incoming request: %v: %v %v %v\n", r.RemoteAddr, r.Proto, r.Method, r.URL)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Hand back anything that's been reshared.
+		if serveBack && r.URL.Path != "/" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			mu.Lock()
+			file, ok := reshared[strings.TrimPrefix(r.URL.Path, "/")]
+			mu.Unlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeFile(w, r, file)
+			return
+		}
 
 		// Display upload form
-		if r.Method != http.MethodPost {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
 			err := tpl.ExecuteTemplate(w, "UploadForm", conf)
 			if err != nil {
 				panic(err)
@@ -240,20 +2610,162 @@ func setupUpload(server *http.Server, conf Config) {
 			return
 		}
 
-		// Handle POSTed upload
+		// Handle uploaded files
+		if full() {
+			fail(w, r, http.StatusGone, errors.New("all the uploads are in, there's no room for another"))
+			return
+		}
+		if conf.MaxSize > 0 {
+			if r.ContentLength > int64(conf.MaxSize) {
+				fail(w, r, http.StatusRequestEntityTooLarge, tooLarge)
+				return
+			}
+			// Content-Length can lie or be missing, so cap the body as well.
+			r.Body = http.MaxBytesReader(w, r.Body, int64(conf.MaxSize))
+		}
+		if feed != nil {
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			w = sw
+			done := feed.track(r)
+			defer func() { done(sw.status < 300 && sw.err == nil) }()
+		}
+
+		// A body that was compressed on the way over is saved as it was before
+		// that. -max-size goes for what it decompresses to as well, so a
+		// little upload can't unpack into a huge one.
+		if !conf.NoDecompress {
+			err := decompressBody(r)
+			var maxErr *http.MaxBytesError
+			switch {
+			case errors.Is(err, errEncoding):
+				fail(w, r, http.StatusUnsupportedMediaType, err)
+				return
+			case errors.As(err, &maxErr):
+				fail(w, r, http.StatusRequestEntityTooLarge, tooLarge)
+				return
+			case err != nil:
+				fail(w, r, http.StatusBadRequest, err)
+				return
+			}
+			if conf.MaxSize > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, int64(conf.MaxSize))
+			}
+		}
+
+		if conf.ToStdout {
+			mu.Lock()
+			busy := streaming
+			streaming = true
+			mu.Unlock()
+			if busy {
+				fail(w, r, http.StatusConflict, errors.New("already receiving a file, try again later"))
+				return
+			}
+
+			saved, err := streamUpload(os.Stdout, r, conf.Field, conf.Accept)
+			if err != nil && saved.Size > 0 {
+				// Whatever's reading stdout already has part of the file, and
+				// there's no taking it back.
+				fmt.Fprintf(os.Stderr, "%v, what was written to stdout is incomplete\n", err)
+				os.Exit(1)
+			}
+			if err != nil {
+				mu.Lock()
+				streaming = false
+				mu.Unlock()
+				var maxErr *http.MaxBytesError
+				switch {
+				case errors.As(err, new(notAccepted)):
+					fail(w, r, http.StatusUnsupportedMediaType, err)
+				case errors.As(err, &maxErr):
+					fail(w, r, http.StatusRequestEntityTooLarge, tooLarge)
+				default:
+					fail(w, r, http.StatusBadRequest, err)
+				}
+				return
+			}
+
+			logger.Info("upload written to stdout", "name", saved.Name, "bytes", saved.Size, "sha256", saved.SHA256)
+			if conf.JSON {
+				writeJSON(w, http.StatusOK, uploadResult{Saved: []string{saved.Name}, Bytes: saved.Size, Files: []savedFile{saved}})
+			} else {
+				writeReceipt(w, r, tpl, receipt{"Upload successful!", []savedFile{saved}})
+			}
+			finish(r, saved)
+			return
+		}
+
+		// curl --upload-file sends a PUT to /<name>.
+		if r.Method == http.MethodPut {
+			name := rawName(r.URL.Path, conf.MaxNameLength)
+			if name == "" {
+				fail(w, r, http.StatusBadRequest, errors.New("no file name provided, PUT the file to /<name>"))
+				return
+			}
+			saved, ok := saveBody(w, r, name)
+			if !ok {
+				return
+			}
+
+			if conf.JSON {
+				writeJSON(w, http.StatusCreated, uploadResult{Saved: []string{saved.Name}, Bytes: saved.Size, Files: []savedFile{saved}})
+			} else {
+				w.WriteHeader(http.StatusCreated)
+				if saved.URL != "" {
+					fmt.Fprintln(w, saved.URL)
+				} else {
+					fmt.Fprintln(w, saved.Name)
+				}
+			}
+			finish(r, saved)
+			return
+		}
+
+		// Scripts can skip the multipart dance and POST the file as-is.
+		if conf.JSON && !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			name := rawName(r.URL.Query().Get("name"), conf.MaxNameLength)
+			if name == "" {
+				fail(w, r, http.StatusBadRequest, errors.New("no file name provided, set one with ?name="))
+				return
+			}
+			saved, ok := saveBody(w, r, name)
+			if !ok {
+				return
+			}
+
+			writeJSON(w, http.StatusOK, uploadResult{Saved: []string{saved.Name}, Bytes: saved.Size, Files: []savedFile{saved}})
+			finish(r, saved)
+			return
+		}
+
 		// Buffer a maximum of 20MB of form data in memory.
-		r.ParseMultipartForm(20 << 20)
+		err := r.ParseMultipartForm(20 << 20)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			fail(w, r, http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+		if err != nil {
+			fail(w, r, http.StatusBadRequest, fmt.Errorf("could not read upload: %w", err))
+			return
+		}
 
 		// Collect all files from the form.
 		// They're stored in a map of slices of file headers.
 		files := make([]*multipart.FileHeader, 0, 1)
-		for _, field := range r.MultipartForm.File {
-			for _, header := range field {
+		for field, headers := range r.MultipartForm.File {
+			if conf.Field != "" && field != conf.Field {
+				fail(w, r, http.StatusBadRequest, fmt.Errorf("files are only accepted in the %q field, not %q", conf.Field, field))
+				return
+			}
+			for _, header := range headers {
 				// Make sure there's only one file if we only expect one.
 				if len(files) > 0 && !conf.Multiple {
-					err := errors.New("multiple files found, only expected one file. start RUFF with -m for multiple file uploads.")
-					tpl.ExecuteTemplate(w, "UploadError", err)
-					fmt.Println(err)
+					fail(w, r, http.StatusBadRequest, errors.New("multiple files found, only expected one file. start RUFF with -m for multiple file uploads."))
+					return
+				}
+				if !accepted(conf.Accept, header.Filename) {
+					fail(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("files of type %q are not accepted, allowed types are: %v", filepath.Ext(header.Filename), strings.Join(conf.Accept, " ")))
 					return
 				}
 				files = append(files, header)
@@ -261,51 +2773,384 @@ func setupUpload(server *http.Server, conf Config) {
 		}
 
 		// Save all files to disk.
+		result := uploadResult{Saved: make([]string, 0, len(files))}
 		for i := range files {
-			err := saveFile(files[i])
+			name := rawName(files[i].Filename, conf.MaxNameLength)
+			if name == "" {
+				fail(w, r, http.StatusBadRequest, fmt.Errorf("could not save file %q: no usable file name", files[i].Filename))
+				return
+			}
+			if conf.KeepStructure {
+				name, err = relativeName(files[i], conf.MaxNameLength)
+				if err != nil {
+					fail(w, r, http.StatusBadRequest, fmt.Errorf("could not save file %v: %w", files[i].Filename, err))
+					return
+				}
+			}
+			name = dated(name)
+
+			saved, err := saveFile(files[i], name, conf.GzipUploads)
+			if err == nil {
+				err = dedupe(&saved)
+			}
 			if err != nil {
-				err = fmt.Errorf("could not save file %v: %w", files[i].Filename, err)
-				tpl.ExecuteTemplate(w, "UploadError", err)
-				fmt.Println(err)
+				fail(w, r, http.StatusInternalServerError, fmt.Errorf("could not save file %v: %w", name, err))
 				return
 			}
+			reshare(r, &saved)
+			result.Saved = append(result.Saved, saved.Name)
+			result.Files = append(result.Files, saved)
+			result.Bytes += saved.Size
 		}
 
-		tpl.ExecuteTemplate(w, "UploadMessage", "Upload successful!")
-		fmt.Println("upload successful")
-		go shutdown(server)
+		if conf.JSON {
+			writeJSON(w, http.StatusOK, result)
+		} else {
+			writeReceipt(w, r, tpl, receipt{"Upload successful!", result.Files})
+		}
+		finish(r, result.Files...)
 	})
 }
 
-// saveFile saves a fileHeader to the current working directory.
-func saveFile(header *multipart.FileHeader) error {
+// rawName turns the file name a client asked for into a bare name to save
+// under, or "" if there's nothing usable in it. Same treatment as
+// relativeName, but only the last element is kept.
+func rawName(requested string, max int) string {
+	name := strings.ReplaceAll(cleanName(requested), `\`, "/")
+	name = filepath.Base(filepath.FromSlash(path.Clean("/" + name)))
+	if name == string(filepath.Separator) || filepath.VolumeName(name) != "" {
+		return ""
+	}
+	name = shortenName(name, max)
+	if !validName(name) {
+		return ""
+	}
+	return name
+}
+
+// cleanName irons out the ways a file name can trip up a filesystem before
+// it's made safe to save under. Phones and Macs like to send decomposed
+// accents, which are put back together so the name matches what everybody
+// else would type, and control characters are dropped.
+func cleanName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, norm.NFC.String(name))
+}
+
+// shortenName cuts a name down to at most max bytes, keeping its extension
+// and not splitting any characters. A max of 0 leaves it be.
+func shortenName(name string, max int) string {
+	if max <= 0 || len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) >= max {
+		ext = ""
+	}
+	cut := max - len(ext)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + ext
+}
+
+// accepted reports whether a file's extension is in the list of allowed
+// extensions. An empty list allows everything.
+func accepted(exts []string, name string) bool {
+	if len(exts) == 0 {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	for i := range exts {
+		if ext == exts[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// relativeName digs the full relative path of an uploaded file out of its
+// headers, since mime/multipart strips it down to the base name. The path is
+// cleaned so it can't climb out of the current directory.
+func relativeName(header *multipart.FileHeader, max int) (string, error) {
+	_, params, err := mime.ParseMediaType(header.Header.Get("Content-Disposition"))
+	if err != nil {
+		return "", fmt.Errorf("could not read file name: %w", err)
+	}
+
+	// Rooting the path before cleaning it eats any leading ../ elements.
+	name := strings.ReplaceAll(cleanName(params["filename"]), `\`, "/")
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "", errors.New("no file name provided")
+	}
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parts[i] = shortenName(parts[i], max)
+		if !validName(parts[i]) {
+			return "", fmt.Errorf("refusing to save to %q", name)
+		}
+	}
+	name = strings.Join(parts, "/")
+
+	local := filepath.FromSlash(name)
+	if filepath.IsAbs(local) || filepath.VolumeName(local) != "" {
+		return "", fmt.Errorf("refusing to save to %q", name)
+	}
+	return local, nil
+}
+
+// savedFile describes a file that was received and written to disk.
+type savedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url,omitempty"`
+	// Stored is the size on disk, if -compress-upload gzipped it.
+	Stored int64 `json:"stored,omitempty"`
+	// Duplicate is the file this one turned out to be identical to with
+	// -dedup, in which case it wasn't kept.
+	Duplicate string `json:"duplicate,omitempty"`
+}
+
+// HumanSize is the file's size for people to read.
+func (f savedFile) HumanSize() string {
+	if f.Stored > 0 {
+		return fmt.Sprintf("%v, %v gzipped", humanSize(f.Size), humanSize(f.Stored))
+	}
+	return humanSize(f.Size)
+}
+
+// receipt is what the UploadMessage template shows after an upload.
+type receipt struct {
+	Message string
+	Files   []savedFile
+}
+
+// wantsText reports whether a client would rather have plain text than a web
+// page, which goes for pretty much anything that isn't a browser, like curl.
+func wantsText(r *http.Request) bool {
+	return !strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// writeReceipt lets the client know how an upload went, as a page for
+// browsers or a line per file for everything else.
+func writeReceipt(w http.ResponseWriter, r *http.Request, tpl *template.Template, rec receipt) {
+	if !wantsText(r) {
+		tpl.ExecuteTemplate(w, "UploadMessage", rec)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, rec.Message)
+	for _, file := range rec.Files {
+		name := file.Name
+		if file.URL != "" {
+			name = file.URL
+		}
+		if file.Duplicate != "" {
+			fmt.Fprintf(w, "%v (%v, duplicate of %v)\n", name, file.HumanSize(), file.Duplicate)
+			continue
+		}
+		fmt.Fprintf(w, "%v (%v)\n", name, file.HumanSize())
+	}
+}
+
+// saveFile saves a fileHeader to name in the current working directory.
+func saveFile(header *multipart.FileHeader, name string, compress bool) (savedFile, error) {
 	inFile, err := header.Open()
 	if err != nil {
-		return fmt.Errorf("could not open uploaded file: %w", err)
+		return savedFile{Name: name}, fmt.Errorf("could not open uploaded file: %w", err)
 	}
 	defer inFile.Close()
 
-	outFile, err := os.Create(header.Filename)
-	// TODO: This might fail if the file already exists, we should handle this
-	// case specially.
+	// TODO: If the file is large enough to be dumped to disk, we could assert it
+	// as an os.File and move the file itself rather than copying it bit by bit.
+	return writeFile(name, inFile, compress)
+}
+
+// writeFile copies everything from r into a new file called name in the
+// current working directory, hashing it along the way. With compress, it's
+// gzipped on the way to disk and saved as name.gz, unless it's already
+// compressed. If the name's taken, it gets a number, see claimName.
+func writeFile(name string, r io.Reader, compress bool) (savedFile, error) {
+	compress = compress && compressible(name)
+	if compress {
+		name += ".gz"
+	}
+	saved := savedFile{Name: name}
+
+	// Write to a .part file and only give it the real name once it's all
+	// there, so half an upload never looks like the real thing.
+	outFile, err := createPart(name)
 	if err != nil {
-		return fmt.Errorf("could not save uploaded file: %w", err)
+		return saved, err
 	}
+	partName := outFile.Name()
+	defer os.Remove(partName)
 	defer outFile.Close()
 
-	// TODO: If the file is large enough to be dumped to disk, we could assert it
-	// as an os.File and move the file itself rather than copying it bit by bit.
-	_, err = io.Copy(outFile, inFile)
+	// The hash and size are of the file as it was sent, compressed or not.
+	var out io.Writer = outFile
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(outFile)
+		out = gz
+	}
+	h := sha256.New()
+	saved.Size, err = io.Copy(io.MultiWriter(out, h), r)
+	if err == nil && compress {
+		err = gz.Close()
+	}
+	if err != nil {
+		return saved, fmt.Errorf("could not copy uploaded file to disk: %w", err)
+	}
+	saved.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if compress {
+		info, err := outFile.Stat()
+		if err != nil {
+			return saved, fmt.Errorf("could not save uploaded file: %w", err)
+		}
+		saved.Stored = info.Size()
+	}
+
+	// CreateTemp keeps the file to ourselves, but uploads have always been
+	// readable by everyone.
+	err = outFile.Chmod(0644)
+	if err == nil {
+		err = outFile.Close()
+	}
+	if err == nil {
+		suffix := ""
+		if compress {
+			name, suffix = strings.TrimSuffix(name, ".gz"), ".gz"
+		}
+		name, err = claimName(partName, name, suffix)
+		saved.Name = name
+	}
 	if err != nil {
-		return fmt.Errorf("could not copy uploaded file to disk: %w", err)
+		return saved, fmt.Errorf("could not save uploaded file: %w", err)
+	}
+
+	bytesReceived.Add(saved.Size)
+	logger.Info("upload saved", "name", name, "bytes", saved.Size, "stored", saved.Stored, "sha256", saved.SHA256)
+	return saved, nil
+}
+
+// naming is held while a finished upload picks its name, so two finishing at
+// once can't both take the same one.
+var naming sync.Mutex
+
+// claimName gives a finished .part file its real name, or if something's
+// already got that name, the first free one of "name (1).ext", "name (2).ext"
+// and so on, so an upload never replaces another file. suffix goes after the
+// number, to keep .gz on the end. It returns the name the file ended up with,
+// or was meant to.
+func claimName(partName, name, suffix string) (string, error) {
+	naming.Lock()
+	defer naming.Unlock()
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	try := name + suffix
+	for i := 1; ; i++ {
+		_, err := os.Lstat(try)
+		if errors.Is(err, fs.ErrNotExist) {
+			return try, os.Rename(partName, try)
+		}
+		if err != nil {
+			return name + suffix, err
+		}
+
+		// The number shouldn't push the name past what the filesystem takes.
+		num := fmt.Sprintf(" (%d)", i)
+		cut := len(stem)
+		if over := len(filepath.Base(stem)) + len(num) + len(ext) + len(suffix) - 255; over > 0 {
+			cut -= over
+			for cut > 0 && !utf8.RuneStart(stem[cut]) {
+				cut--
+			}
+		}
+		try = stem[:cut] + num + ext + suffix
 	}
+}
 
-	fmt.Printf("Received file: %v\n", header.Filename)
+// checkSymlinks refuses a path if anything along it is a symlink. MkdirAll
+// and Create would happily follow one, which would let an upload land outside
+// the directory RUFF was started in.
+func checkSymlinks(name string) error {
+	p := ""
+	for _, part := range strings.Split(filepath.Clean(name), string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not check %v: %w", p, err)
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to save through symlink %v", p)
+		}
+	}
 	return nil
 }
 
+// sidesLeft is how many sides of a -duplex session, sending the file and
+// taking uploads, are still going besides the last one. Otherwise there's only
+// the one side, so it's 0.
+var sidesLeft atomic.Int32
+
+// finished is called when a side's done, shutting down if it was the last
+// one going. With -linger, anyone who shows up after that is told they just
+// missed it for a while first, rather than finding nothing there at all.
+func finished(server *http.Server, conf Config) {
+	if sidesLeft.Add(-1) >= 0 {
+		logger.Info("one side finished, waiting on the other")
+		return
+	}
+	if conf.Linger > 0 {
+		ended.Store(true)
+		logger.Info("lingering", "for", conf.Linger.String())
+		time.Sleep(conf.Linger)
+	}
+	shutdown(server, conf.Grace)
+}
+
+// ended is set once there's nothing left to do but linger.
+var ended atomic.Bool
+
+// turnAway wraps a handler so that once the transfer's ended, any new
+// requests get a page saying so instead. Transfers already going carry on.
+func turnAway(tpl *template.Template, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ended.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusGone)
+		tpl.ExecuteTemplate(w, "Ended", nil)
+	})
+}
+
 // shutdown shuts down the HTTP server, sending a signal when it's complete.
-func shutdown(server *http.Server) {
-	server.Shutdown(context.Background())
+// Active transfers get up to grace to finish, or forever if grace is 0.
+func shutdown(server *http.Server, grace time.Duration) {
+	ctx := context.Background()
+	if grace > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grace)
+		defer cancel()
+	}
+
+	logger.Info("shutdown")
+	server.Shutdown(ctx)
+	waitH2C(ctx)
+	waitWebhooks(ctx)
 	done <- struct{}{}
 }
@@ -0,0 +1,2264 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"rsc.io/qr"
+)
+
+func init() {
+	output = io.Discard
+}
+
+// inTempDir runs the test from a fresh directory so uploads land somewhere
+// disposable.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func TestByteSizeSet(t *testing.T) {
+	tests := []struct {
+		in   string
+		want byteSize
+		err  bool
+	}{
+		{"512", 512, false},
+		{"1K", 1 << 10, false},
+		{"100M", 100 << 20, false},
+		{"2GB", 2 << 30, false},
+		{" 3g ", 3 << 30, false},
+		{"1E", 1 << 60, false},
+		{"8E", 0, true},
+		{"-1", 0, true},
+		{"", 0, true},
+		{"M", 0, true},
+		{"12X", 0, true},
+	}
+
+	for _, tt := range tests {
+		var b byteSize
+		err := b.Set(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("Set(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !tt.err && b != tt.want {
+			t.Errorf("Set(%q) = %d, want %d", tt.in, b, tt.want)
+		}
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	dir := inTempDir(t)
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, err := mw.CreateFormFile("file", "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte("x"), 4096))
+	mw.Close()
+
+	tests := []struct {
+		name        string
+		json        bool
+		contentType string
+		body        []byte
+		chunked     bool
+	}{
+		{"multipart", false, mw.FormDataContentType(), form.Bytes(), false},
+		{"multipart chunked", false, mw.FormDataContentType(), form.Bytes(), true},
+		{"raw chunked", true, "application/octet-stream", bytes.Repeat([]byte("x"), 4096), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := Config{Uploading: true, Multiple: true, MaxSize: 1024, JSON: tt.json}
+			mux := http.NewServeMux()
+			setupUpload(mux, &http.Server{}, conf, tpl)
+
+			req := httptest.NewRequest(http.MethodPost, "/?name=big.bin", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("got status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("upload left %d file(s) behind", len(entries))
+			}
+		})
+	}
+}
+
+func TestRawUploadName(t *testing.T) {
+	dir := inTempDir(t)
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Uploading: true, Multiple: true, JSON: true}
+	mux := http.NewServeMux()
+	setupUpload(mux, &http.Server{}, conf, tpl)
+
+	req := httptest.NewRequest(http.MethodPost, `/?name=..\..\notes.txt`, bytes.NewReader([]byte("hello")))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("upload wasn't saved as notes.txt: %v", err)
+	}
+}
+
+func TestUploadNameCleanup(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	emoji := strings.Repeat("🐶", 100)
+	for _, c := range []struct {
+		requested string
+		max       int
+		want      string
+	}{
+		{"party 🎉.jpg", 255, "party 🎉.jpg"},
+		// e followed by a combining acute accent comes out as a single é.
+		{"cafe\u0301.txt", 255, "caf\u00e9.txt"},
+		{"bell\a\x00.txt", 255, "bell.txt"},
+		{"../line\nbreak.txt", 255, "linebreak.txt"},
+		{long + ".tar.gz", 255, strings.Repeat("a", 252) + ".gz"},
+		{long, 0, long},
+		// Four bytes each, so only whole dogs make the cut.
+		{emoji + ".png", 255, strings.Repeat("🐶", 62) + ".png"},
+		// Dropping the control characters mustn't leave a way up.
+		{".\x01.", 255, ""},
+		{"\x01", 255, ""},
+	} {
+		if got := rawName(c.requested, c.max); got != c.want {
+			t.Errorf("rawName(%q, %d) = %q, want %q", c.requested, c.max, got, c.want)
+		}
+		if len(c.want) > 255 && c.max == 255 {
+			t.Errorf("%q is over the limit", c.want)
+		}
+	}
+
+	header := &multipart.FileHeader{Header: map[string][]string{
+		"Content-Disposition": {"form-data; name=\"file\"; filename=\"" + long + "/cafe\u0301.txt\""},
+	}}
+	got, err := relativeName(header, 255)
+	if want := filepath.Join(strings.Repeat("a", 255), "caf\u00e9.txt"); err != nil || got != want {
+		t.Errorf("relativeName got %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestHeadDoesNotCount(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Downloads: 1, Total: -1, FilePath: file, FileName: "hello.txt"}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	// With a single download on offer, the HEAD mustn't use it up, and the
+	// GET after it must.
+	steps := []struct {
+		method string
+		want   int
+	}{
+		{http.MethodHead, http.StatusOK},
+		{http.MethodGet, http.StatusOK},
+		{http.MethodGet, http.StatusGone},
+	}
+	for _, step := range steps {
+		req := httptest.NewRequest(step.method, "/hello.txt", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != step.want {
+			t.Fatalf("%v got status %d, want %d", step.method, rec.Code, step.want)
+		}
+	}
+}
+
+func TestWriteFileRefusesSymlinks(t *testing.T) {
+	inTempDir(t)
+	outside := t.TempDir()
+	if err := os.Symlink(outside, "sneaky"); err != nil {
+		t.Skip("can't make symlinks here:", err)
+	}
+
+	_, err := writeFile(filepath.Join("sneaky", "evil.txt"), bytes.NewReader([]byte("boo")), false)
+	if err == nil {
+		t.Fatal("writeFile followed a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil.txt")); err == nil {
+		t.Error("file was written outside the upload directory")
+	}
+}
+
+// failingReader hands out a little data, then fails like a dropped
+// connection.
+type failingReader struct {
+	sent bool
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.sent {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.sent = true
+	return copy(b, "half a fi"), nil
+}
+
+func TestWriteFileCleansUp(t *testing.T) {
+	dir := inTempDir(t)
+
+	_, err := writeFile("notes.txt", &failingReader{}, false)
+	if err == nil {
+		t.Fatal("writeFile didn't report the failed copy")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%v was left behind", entry.Name())
+	}
+
+	saved, err := writeFile("notes.txt", strings.NewReader("the whole file"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("notes.txt")
+	if err != nil || string(data) != "the whole file" || saved.Size != int64(len(data)) {
+		t.Errorf("got %q, %v, want the whole file", data, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("got %d files, want just notes.txt", len(entries))
+	}
+}
+
+func TestWriteFileCompressed(t *testing.T) {
+	inTempDir(t)
+
+	text := bytes.Repeat([]byte("all work and no play "), 100)
+	saved, err := writeFile("notes.txt", bytes.NewReader(text), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Name != "notes.txt.gz" || saved.Size != int64(len(text)) || saved.Stored == 0 || saved.Stored >= saved.Size {
+		t.Errorf("got %+v", saved)
+	}
+	f, err := os.Open("notes.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil || !bytes.Equal(got, text) {
+		t.Errorf("notes.txt.gz didn't unzip to the upload: %v", err)
+	}
+
+	// Zipping a zip is a waste of time.
+	saved, err = writeFile("photos.zip", bytes.NewReader(text), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Name != "photos.zip" || saved.Stored != 0 {
+		t.Errorf("got %+v, want photos.zip saved as-is", saved)
+	}
+}
+
+func TestPerIPUnlimited(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Downloads: 0, Wait: true, PerIP: true, Total: -1, FilePath: file, FileName: "hello.txt"}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hello.txt", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("download %d got status %d, want %d", i+1, rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	dir := inTempDir(t)
+	name := filepath.Join(dir, "state.json")
+
+	if _, ok, err := loadState(name); ok || err != nil {
+		t.Fatalf("loadState on a missing file = %v, %v, want false, nil", ok, err)
+	}
+	if err := saveState(name, 3); err != nil {
+		t.Fatal(err)
+	}
+	remaining, ok, err := loadState(name)
+	if err != nil || !ok || remaining != 3 {
+		t.Fatalf("loadState = %v, %v, %v, want 3, true, nil", remaining, ok, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("saveState left %d files behind, want just the state", len(entries))
+	}
+}
+
+func TestPutUpload(t *testing.T) {
+	dir := inTempDir(t)
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Uploading: true, Multiple: true}
+	mux := http.NewServeMux()
+	setupUpload(mux, &http.Server{}, conf, tpl)
+
+	req := httptest.NewRequest(http.MethodPut, "/notes.txt", bytes.NewReader([]byte("hello")))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "notes.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("got %q, %v, want the uploaded file", data, err)
+	}
+}
+
+func TestDecompressUpload(t *testing.T) {
+	dir := inTempDir(t)
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gz, z bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte("hello, hello, hello"))
+	gw.Close()
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte("hello, hello, hello"))
+	zw.Close()
+	var bomb bytes.Buffer
+	bw := gzip.NewWriter(&bomb)
+	bw.Write(make([]byte, 1<<20))
+	bw.Close()
+
+	for _, tt := range []struct {
+		name     string
+		raw      bool
+		encoding string
+		body     []byte
+		status   int
+		want     string
+	}{
+		{"gzip.txt", false, "gzip", gz.Bytes(), http.StatusCreated, "hello, hello, hello"},
+		{"deflate.txt", false, "deflate", z.Bytes(), http.StatusCreated, "hello, hello, hello"},
+		{"raw.txt.gz", true, "gzip", gz.Bytes(), http.StatusCreated, gz.String()},
+		{"cut-short.txt", false, "gzip", gz.Bytes()[:gz.Len()-6], http.StatusBadRequest, ""},
+		{"not-gzip.txt", false, "gzip", []byte("hello"), http.StatusBadRequest, ""},
+		{"brotli.txt", false, "br", []byte("hello"), http.StatusUnsupportedMediaType, ""},
+		{"bomb.txt", false, "gzip", bomb.Bytes(), http.StatusRequestEntityTooLarge, ""},
+	} {
+		conf := Config{Uploading: true, Multiple: true, MaxSize: 64 << 10, NoDecompress: tt.raw}
+		mux := http.NewServeMux()
+		setupUpload(mux, &http.Server{}, conf, tpl)
+
+		req := httptest.NewRequest(http.MethodPut, "/"+tt.name, bytes.NewReader(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%v: got status %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, tt.name))
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%v: saved %q from a bad upload", tt.name, data)
+			}
+			continue
+		}
+		if err != nil || string(data) != tt.want {
+			t.Errorf("%v: got %q, %v, want %q", tt.name, data, err, tt.want)
+		}
+	}
+
+	// A cut short upload says what went wrong.
+	conf := Config{Uploading: true}
+	mux := http.NewServeMux()
+	setupUpload(mux, &http.Server{}, conf, tpl)
+	req := httptest.NewRequest(http.MethodPut, "/notes.txt", bytes.NewReader(gz.Bytes()[:gz.Len()-6]))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept", "text/plain")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), "could not decompress upload, it was cut short") {
+		t.Errorf("got %q", rec.Body.String())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := inTempDir(t)
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Uploading: true, Uploads: 1, Verify: time.Minute, Tus: true}
+	mux := http.NewServeMux()
+	setupUpload(mux, &http.Server{}, conf, tpl)
+
+	// Start one upload and leave it halfway.
+	pr, pw := io.Pipe()
+	slow := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/slow.txt", pr))
+		slow <- rec
+	}()
+	pw.Write([]byte("the slow "))
+	for {
+		parts, _ := filepath.Glob(filepath.Join(dir, "*.part"))
+		if len(parts) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/notes.txt", strings.NewReader("hello")))
+	if rec.Code != http.StatusCreated || strings.TrimSpace(rec.Body.String()) != "http://example.com/notes.txt" {
+		t.Fatalf("got status %d and %q, want the file's URL", rec.Code, rec.Body.String())
+	}
+
+	// The one already going gets to finish, but that doesn't make room for
+	// another.
+	pw.Write([]byte("one"))
+	pw.Close()
+	if rec := <-slow; rec.Code != http.StatusCreated {
+		t.Errorf("slow upload got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	// What came in can be fetched back to check it.
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/notes.txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Errorf("got status %d and %q, want the upload back", rec.Code, rec.Body.String())
+	}
+
+	// But that was the last upload, so there's no sending another, the usual
+	// way or over tus.
+	req := httptest.NewRequest(http.MethodPut, "/more.txt", strings.NewReader("again"))
+	req.Header.Set("Accept", "text/plain")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusGone {
+		t.Errorf("got status %d for an upload past the last, want %d", rec.Code, http.StatusGone)
+	}
+	if _, err := os.Stat("more.txt"); err == nil {
+		t.Error("saved an upload past the last")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/tus/", nil)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", "5")
+	req.Header.Set("Upload-Metadata", "filename bW9yZS50eHQ=")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusGone {
+		t.Errorf("got status %d for a tus upload past the last, want %d", rec.Code, http.StatusGone)
+	}
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	dir := inTempDir(t)
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Uploading: true, Uploads: -1, Multiple: true}
+	mux := http.NewServeMux()
+	setupUpload(mux, &http.Server{}, conf, tpl)
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPut, "/photo.jpg", strings.NewReader(fmt.Sprint("photo ", i)))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusCreated {
+				t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every upload should have landed somewhere of its own.
+	seen := make(map[string]bool)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[string(data)] = true
+	}
+	if len(entries) != n || len(seen) != n {
+		t.Errorf("got %d files with %d different uploads, want %d of each", len(entries), len(seen), n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "photo (9).jpg")); err != nil {
+		t.Errorf("uploads weren't numbered: %v", err)
+	}
+}
+
+func TestShutdownWaitsForUploads(t *testing.T) {
+	dir := inTempDir(t)
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Uploading: true, Uploads: 1, Multiple: true}
+	mux := http.NewServeMux()
+	ts := httptest.NewUnstartedServer(mux)
+	setupUpload(mux, ts.Config, conf, tpl)
+	ts.Start()
+	defer ts.Close()
+
+	put := func(body io.Reader) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/photo.jpg", body)
+		if err != nil {
+			return nil, err
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	// Start one upload and leave it halfway.
+	pr, pw := io.Pipe()
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := put(pr)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				err = fmt.Errorf("got status %d", resp.StatusCode)
+			}
+		}
+		slow <- err
+	}()
+	pw.Write([]byte("the slow "))
+	for {
+		parts, _ := filepath.Glob(filepath.Join(dir, "*.part"))
+		if len(parts) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The last upload finishing shouldn't cut off the one still going.
+	resp, err := put(strings.NewReader("the quick one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	time.Sleep(50 * time.Millisecond)
+	pw.Write([]byte("one"))
+	pw.Close()
+	if err := <-slow; err != nil {
+		t.Fatalf("slow upload failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't shut down")
+	}
+
+	for name, want := range map[string]string{"photo.jpg": "the quick one", "photo (1).jpg": "the slow one"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%v: got %q, %v, want %q", name, data, err, want)
+		}
+	}
+}
+
+func TestDuplex(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "give.txt")
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sidesLeft.Store(0) })
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Downloads: 1, Total: -1, Uploads: 1, Uploading: true, Multiple: true, Duplex: true, FilePath: file, FileName: "give.txt", URLPath: "give.txt"}
+	mux := http.NewServeMux()
+	ts := httptest.NewUnstartedServer(mux)
+	setupDuplex(mux, ts.Config, conf, tpl)
+	ts.Start()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(form), `action="/upload/"`) {
+		t.Errorf("upload form doesn't post to /upload/:\n%s", form)
+	}
+
+	resp, err = http.Get(ts.URL + "/give.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "hello" {
+		t.Errorf("got %q, want the file", data)
+	}
+
+	// The download's done, but there's still an upload to take.
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/upload/back.txt", strings.NewReader("hi back"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("server shut down before the upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "back.txt"))
+	if err != nil || string(data) != "hi back" {
+		t.Errorf("got %q, %v, want the upload", data, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't shut down once both sides were done")
+	}
+}
+
+func TestTunedListener(t *testing.T) {
+	server := &http.Server{Addr: "127.0.0.1:0"}
+	ln, err := listen(Config{ReadBuffer: fastBuffer, WriteBuffer: fastBuffer}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, ok := ln.(tunedListener); !ok {
+		t.Fatalf("got a %T, want the buffers set", ln)
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Things like -controls need to get at the real connection.
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Errorf("got a %T, want a *net.TCPConn", conn)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	// Nothing to tune, nothing to wrap.
+	plain, err := listen(Config{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+	if _, ok := plain.(tunedListener); ok {
+		t.Error("listener was wrapped without any buffers to set")
+	}
+}
+
+func TestHyperlink(t *testing.T) {
+	link := "http://192.168.1.2:8008/cool thing.jpg"
+	want := "\x1b]8;;http://192.168.1.2:8008/cool%20thing.jpg\x1b\\" + link + "\x1b]8;;\x1b\\"
+	if got := osc8(link); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Pipes and files get the plain link.
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, w := range []io.Writer{f, &bytes.Buffer{}, io.Discard} {
+		if got := hyperlink(w, link); got != link {
+			t.Errorf("%T: got %q, want it left alone", w, got)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if broken {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-report")
+		io.WriteString(w, "report body")
+	}))
+	defer upstream.Close()
+
+	link := upstream.URL + "/files/report.pdf?v=2"
+	if !isRelay(link) || isRelay("report.pdf") || isRelay("ftp://example.com/report.pdf") {
+		t.Error("isRelay got it wrong")
+	}
+	if name := defaultName(link, false); name != "report.pdf" {
+		t.Errorf("got name %q, want report.pdf", name)
+	}
+	if name := defaultName(upstream.URL, false); name != "" {
+		t.Errorf("got name %q for a URL without one", name)
+	}
+
+	conf := Config{Downloads: 1, Total: -1, Relay: true, FilePath: link, FileName: "report.pdf", URLPath: "report.pdf"}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+	get := func(method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/report.pdf", nil))
+		return rec
+	}
+
+	// Neither of these gets the file, so neither counts.
+	if rec := get(http.MethodHead); rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "11" {
+		t.Errorf("HEAD got status %d, length %q", rec.Code, rec.Header().Get("Content-Length"))
+	}
+	broken = true
+	if rec := get(http.MethodGet); rec.Code != http.StatusBadGateway {
+		t.Errorf("got status %d from a broken upstream, want %d", rec.Code, http.StatusBadGateway)
+	}
+
+	broken = false
+	rec := get(http.MethodGet)
+	if rec.Code != http.StatusOK || rec.Body.String() != "report body" {
+		t.Fatalf("got status %d with %q", rec.Code, rec.Body)
+	}
+	if ctype := rec.Header().Get("Content-Type"); ctype != "application/x-report" {
+		t.Errorf("got Content-Type %q, want upstream's", ctype)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, "report.pdf") {
+		t.Errorf("got Content-Disposition %q", cd)
+	}
+	if rec := get(http.MethodGet); rec.Code != http.StatusGone {
+		t.Errorf("got status %d after the last download, want %d", rec.Code, http.StatusGone)
+	}
+}
+
+func TestChecksumFile(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "report.txt")
+	if err := os.WriteFile(file, []byte("report body\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The checksum's worked out once and kept, so forget any from before.
+	checksumOnce = sync.Once{}
+	t.Cleanup(func() { checksumOnce = sync.Once{} })
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Downloads: 1, Total: -1, Checksum: true, FilePath: file, FileName: "report.txt", URLPath: "dl"}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dl.sha256", nil))
+	want := "92455f427ad655c4a7d21709eb2d121d5567e30736c2614e6dcab1af884c8252  report.txt\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("got status %d with %q, want %q", rec.Code, rec.Body, want)
+	}
+
+	// That wasn't the download.
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dl", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("download after the checksum got status %d", rec.Code)
+	}
+
+	// Served from /, it's still at the file's name.
+	conf.Root = true
+	if p := conf.checksumPath(); p != "/report.txt.sha256" {
+		t.Errorf("got %v with -root, want /report.txt.sha256", p)
+	}
+}
+
+func TestQRLevel(t *testing.T) {
+	// Find a URL that's a size smaller with low error correction. Plenty of
+	// them come out the same size either way.
+	var text string
+	var medium, low int
+	for n := 1; low >= medium; n++ {
+		text = "http://192.168.1.2:8008/" + strings.Repeat("a", n)
+		medium, low = qrWidth(text, qr.M), qrWidth(text, qr.L)
+	}
+
+	for _, tt := range []struct {
+		width int
+		level qr.Level
+		ok    bool
+	}{
+		{-1, qr.M, true},
+		{medium, qr.M, true},
+		{medium - 1, qr.L, true},
+		{low, qr.L, true},
+		{low - 1, qr.M, false},
+	} {
+		level, need, ok := qrLevel(text, tt.width)
+		if level != tt.level || ok != tt.ok {
+			t.Errorf("%v columns: got level %v, %v, want %v, %v", tt.width, level, ok, tt.level, tt.ok)
+		}
+		if !ok && need != low {
+			t.Errorf("%v columns: says it needs %v, want %v", tt.width, need, low)
+		}
+	}
+
+	// Output that isn't a terminal always gets the code.
+	var b bytes.Buffer
+	if _, ok := drawQR(&b, text); !ok || b.Len() == 0 {
+		t.Error("QR code wasn't drawn")
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	for _, tt := range []struct{ name, want string }{
+		{"holiday.jpg", `attachment; filename="holiday.jpg"`},
+		{"cool thing.jpg", `attachment; filename="cool thing.jpg"`},
+		{`say "hi".txt`, `attachment; filename="say \"hi\".txt"`},
+		{"r\u00e9sum\u00e9.pdf", `attachment; filename="resume.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"\u5831\u544a\u66f8.pdf", `attachment; filename="___.pdf"; filename*=UTF-8''%E5%A0%B1%E5%91%8A%E6%9B%B8.pdf`},
+	} {
+		got := attachment(tt.name)
+		if got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+		// Whatever it looks like, it has to come back out as the same name.
+		_, params, err := mime.ParseMediaType(got)
+		if err != nil || params["filename"] != tt.name {
+			t.Errorf("%v: parsed as %q, %v", tt.name, params["filename"], err)
+		}
+	}
+
+	// And that's what downloads get.
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "cv.pdf")
+	if err := os.WriteFile(file, []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Downloads: 1, Total: -1, FilePath: file, FileName: "r\u00e9sum\u00e9.pdf", URLPath: "cv.pdf"}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cv.pdf", nil))
+	if cd := rec.Header().Get("Content-Disposition"); cd != attachment(conf.FileName) {
+		t.Errorf("got Content-Disposition %q", cd)
+	}
+}
+
+func TestLimitConns(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := limitConns(2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	// Fill up both slots, then anything else should be turned away.
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			codes <- rec.Code
+		}()
+		<-entered
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("request over the limit got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("request within the limit got status %d, want %d", code, http.StatusOK)
+		}
+	}
+}
+
+func TestAllowOnly(t *testing.T) {
+	var allowed []*net.IPNet
+	for _, cidr := range []string{"192.168.1.0/24", "10.0.0.5/32"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed = append(allowed, network)
+	}
+	handler := allowOnly(allowed, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for addr, want := range map[string]int{
+		"192.168.1.5:1234": http.StatusOK,
+		"10.0.0.5:1234":    http.StatusOK,
+		"10.0.0.6:1234":    http.StatusForbidden,
+		"192.168.2.5:1234": http.StatusForbidden,
+		"@":                http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%v got status %d, want %d", addr, rec.Code, want)
+		}
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	handler := limitRate(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := get("192.168.1.5:1234"); rec.Code != http.StatusOK {
+			t.Errorf("request %d got status %d, want %d", i, rec.Code, http.StatusOK)
+		}
+	}
+	rec := get("192.168.1.5:5678")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "20" {
+		t.Errorf("request over the limit got status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Someone else shouldn't be held back by the first device.
+	if rec := get("192.168.1.6:1234"); rec.Code != http.StatusOK {
+		t.Errorf("another device got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestPickIP(t *testing.T) {
+	cidr := func(s string) net.Addr {
+		ip, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnet.IP = ip
+		return ipnet
+	}
+
+	tests := []struct {
+		name  string
+		addrs []net.Addr
+		want  string
+		err   bool
+	}{
+		{"private IPv4", []net.Addr{cidr("127.0.0.1/8"), cidr("192.168.1.20/24")}, "192.168.1.20", false},
+		{"IPv4 over IPv6", []net.Addr{cidr("fd00::5/64"), cidr("10.0.0.7/8")}, "10.0.0.7", false},
+		{"IPv6 only", []net.Addr{cidr("::1/128"), cidr("fe80::1/64"), cidr("fd12::9/64")}, "fd12::9", false},
+		{"public skipped", []net.Addr{cidr("8.8.4.4/24"), cidr("172.16.0.3/12")}, "172.16.0.3", false},
+		{"nothing usable", []net.Addr{cidr("127.0.0.1/8"), cidr("::1/128")}, "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := pickIP(tt.addrs)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%v: pickIP = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestGzip(t *testing.T) {
+	dir := inTempDir(t)
+	text := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 100)
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), text, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Downloads: -1, Total: -1, Gzip: true, FilePath: filepath.Join(dir, "notes.txt"), FileName: "notes.txt"}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	req := httptest.NewRequest(http.MethodGet, "/notes.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Values("Vary"); len(got) != 1 || got[0] != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/plain; charset=utf-8", got)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, text) {
+		t.Error("decompressed body doesn't match the file")
+	}
+
+	// Clients that didn't ask for gzip get the file as-is.
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/notes.txt", nil))
+	if rec.Header().Get("Content-Encoding") != "" || !bytes.Equal(rec.Body.Bytes(), text) {
+		t.Error("uncompressed download didn't match the file")
+	}
+	// Caches still need to know it could have gone the other way.
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q on the uncompressed download, want Accept-Encoding", got)
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	for name, want := range map[string]bool{
+		"notes.txt":  true,
+		"data.JSON":  true,
+		"photo.JPG":  false,
+		"backup.zip": false,
+		"movie.mp4":  false,
+		"Makefile":   true,
+	} {
+		if got := compressible(name); got != want {
+			t.Errorf("compressible(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestNotModifiedDoesNotCount(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Downloads: 2, Total: -1, FilePath: file, FileName: "hello.txt"}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/hello.txt", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first download got status %d and ETag %q", rec.Code, etag)
+	}
+	lastModified := rec.Header().Get("Last-Modified")
+
+	// Neither of these sends the file, so the second download is still left.
+	if rec := get("If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match got status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if rec := get("If-Modified-Since", lastModified); rec.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since got status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if rec := get("", ""); rec.Code != http.StatusOK {
+		t.Errorf("second download got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := get("", ""); rec.Code != http.StatusGone {
+		t.Errorf("third download got status %d, want %d", rec.Code, http.StatusGone)
+	}
+}
+
+func TestRangesCountOnce(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "movie.mp4")
+	if err := os.WriteFile(file, bytes.Repeat([]byte("frame"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Downloads: 1, Total: -1, FilePath: file, FileName: "movie.mp4"}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	// A player buffering and seeking around uses up the one download between
+	// all its range requests, but nobody else gets a look in.
+	steps := []struct {
+		remote, rng string
+		want        int
+	}{
+		{"192.0.2.1:1000", "bytes=0-", http.StatusPartialContent},
+		{"192.0.2.1:1001", "bytes=2000-2999", http.StatusPartialContent},
+		{"192.0.2.1:1002", "bytes=100-199,4000-", http.StatusPartialContent},
+		{"192.0.2.1:1003", "bytes=0-99", http.StatusPartialContent},
+		{"192.0.2.2:1000", "bytes=0-", http.StatusGone},
+		{"192.0.2.1:1004", "", http.StatusGone},
+	}
+	for _, step := range steps {
+		req := httptest.NewRequest(http.MethodGet, "/movie.mp4", nil)
+		req.RemoteAddr = step.remote
+		if step.rng != "" {
+			req.Header.Set("Range", step.rng)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != step.want {
+			t.Errorf("%v with range %q got status %d, want %d", step.remote, step.rng, rec.Code, step.want)
+		}
+	}
+}
+
+func TestBadRangeDoesNotStartStream(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "movie.mp4")
+	if err := os.WriteFile(file, []byte("frame"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Downloads: 1, Total: -1, FilePath: file, FileName: "movie.mp4"}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	// An unsatisfiable range sends nothing, so it mustn't open the door to
+	// free range requests afterwards either.
+	for _, rng := range []string{"bytes=9000-", "bytes=0-", "bytes=0-"} {
+		req := httptest.NewRequest(http.MethodGet, "/movie.mp4", nil)
+		req.Header.Set("Range", rng)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rng == "bytes=9000-" && rec.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("bad range got status %d, want %d", rec.Code, http.StatusRequestedRangeNotSatisfiable)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/movie.mp4", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusGone {
+		t.Errorf("download after the stream got status %d, want %d", rec.Code, http.StatusGone)
+	}
+}
+
+func TestPathAndName(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "IMG_4032.jpg")
+	if err := os.WriteFile(file, []byte("photo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Downloads: -1, Total: -1, FilePath: file, FileName: "holiday.jpg", URLPath: "dl"}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if loc := rec.Header().Get("Location"); loc != "/dl" {
+		t.Errorf("/ redirected to %q, want /dl", loc)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dl", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="holiday.jpg"` {
+		t.Errorf("got Content-Disposition %q", cd)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/holiday.jpg", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("-name was served as a path too, got status %d", rec.Code)
+	}
+}
+
+func TestDefaultNameNeverRedirectsToItself(t *testing.T) {
+	dir := inTempDir(t)
+	for _, c := range []struct {
+		path    string
+		archive bool
+		want    string
+	}{
+		{"/", false, ""},
+		{".", false, ""},
+		{"", false, ""},
+		{"/", true, ""},
+		{"notes.txt", false, "notes.txt"},
+		{"photos/", true, "photos.tar.gz"},
+		{".", true, filepath.Base(dir) + ".tar.gz"},
+	} {
+		got := defaultName(c.path, c.archive)
+		if got != c.want {
+			t.Errorf("defaultName(%q, %v) = %q, want %q", c.path, c.archive, got, c.want)
+		}
+		if got == "" {
+			continue
+		}
+
+		// Whatever name comes out, / has to send people somewhere else.
+		conf := Config{Downloads: -1, Total: -1, FilePath: c.path, FileName: got, URLPath: got}
+		tpl, err := loadTemplates("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		setupDownload(mux, &http.Server{}, conf, tpl)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || loc == "" || loc == "/" {
+			t.Errorf("%q: / got status %d, redirected to %q", c.path, rec.Code, loc)
+		}
+	}
+}
+
+func TestAlias(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "report-2024.pdf")
+	if err := os.WriteFile(file, []byte("report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Downloads: 2, FilePath: file, FileName: "report-2024.pdf", Alias: "latest"}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	// Both paths hand out the file under its real name, from the same count.
+	for _, path := range []string{"/latest", "/report-2024.pdf"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "report" {
+			t.Fatalf("%v got status %d, body %q", path, rec.Code, rec.Body.String())
+		}
+		if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="report-2024.pdf"` {
+			t.Errorf("%v got Content-Disposition %q", path, cd)
+		}
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/latest", nil))
+	if rec.Code != http.StatusGone {
+		t.Errorf("third download got status %d, want %d", rec.Code, http.StatusGone)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	handler, err := serveH2C(srv.Config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.Handler = handler
+	srv.Start()
+	defer srv.Close()
+
+	// Speaking HTTP/2 from the get-go, no upgrade.
+	h2 := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	tests := []struct {
+		client *http.Client
+		want   string
+	}{
+		{h2, "HTTP/2.0"},
+		{srv.Client(), "HTTP/1.1"},
+	}
+	for _, test := range tests {
+		resp, err := test.client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != test.want || resp.Proto != test.want {
+			t.Errorf("handler saw %s, client saw %s, want %s", body, resp.Proto, test.want)
+		}
+	}
+}
+
+// brokenWriter is a client that hangs up as soon as anything's sent.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w brokenWriter) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestDeleteAfter(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(file, []byte("shh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Downloads: 1, Total: -1, DeleteAfter: true, FilePath: file, FileName: "secret.txt"}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	// A download that gets cut off leaves the file, and the download, for
+	// somebody else.
+	mux.ServeHTTP(brokenWriter{httptest.NewRecorder()}, httptest.NewRequest(http.MethodGet, "/secret.txt", nil))
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("file was deleted after a broken download: %v", err)
+	}
+
+	// So does one that only asks for part of it, rather than using up the
+	// last download and leaving the file behind.
+	req := httptest.NewRequest(http.MethodGet, "/secret.txt", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("file was deleted after a range request: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/secret.txt", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if _, err := os.Stat(file); err == nil {
+		t.Error("file is still there after the last download")
+	}
+}
+
+func TestLinger(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "handout.pdf")
+	if err := os.WriteFile(file, []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Downloads: 1, Total: -1, Linger: time.Minute, FilePath: file, FileName: "handout.pdf"}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+	handler := turnAway(tpl, mux)
+	t.Cleanup(func() { ended.Store(false) })
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/handout.pdf", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// The last download shuts things down in the background, so give it a
+	// moment to get there.
+	deadline := time.Now().Add(5 * time.Second)
+	for !ended.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("never started lingering after the last download")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Anybody late gets told so, whatever they asked for.
+	for _, path := range []string{"/handout.pdf", "/", "/meta.json"} {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusGone {
+			t.Errorf("%v: got status %d, want %d", path, rec.Code, http.StatusGone)
+		}
+		if !strings.Contains(rec.Body.String(), "This transfer has ended") {
+			t.Errorf("%v: got %q", path, rec.Body.String())
+		}
+		if rec.Header().Get("Connection") != "close" {
+			t.Errorf("%v: connection left open", path)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "contract.pdf")
+	if err := os.WriteFile(file, []byte("sign here"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := makeTokens(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens[0] == tokens[1] {
+		t.Fatalf("got the same token twice: %v", tokens)
+	}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Downloads: 1, Total: -1, FilePath: file, FileName: "contract.pdf", Links: 2, Tokens: tokens}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+	links := conf.linkPaths()
+
+	get := func(w http.ResponseWriter, method, path string, header http.Header) {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		mux.ServeHTTP(w, req)
+	}
+
+	// Without a token there's no file.
+	rec := httptest.NewRecorder()
+	get(rec, http.MethodGet, "/contract.pdf", nil)
+	if rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), "contract.pdf") {
+		t.Errorf("got status %d and %q without a token", rec.Code, rec.Body.String())
+	}
+
+	// A download that's cut off leaves the link good for another go, and a
+	// range gets the whole file so a link can't be picked at a bit at a time.
+	get(brokenWriter{httptest.NewRecorder()}, http.MethodGet, links[0], nil)
+	rec = httptest.NewRecorder()
+	get(rec, http.MethodGet, links[0], http.Header{"Range": {"bytes=0-3"}})
+	if rec.Code != http.StatusOK || rec.Body.String() != "sign here" {
+		t.Fatalf("got status %d and %q, want the whole file", rec.Code, rec.Body.String())
+	}
+
+	// Then it's dead.
+	rec = httptest.NewRecorder()
+	get(rec, http.MethodGet, links[0], nil)
+	if rec.Code != http.StatusGone {
+		t.Errorf("reusing a link got status %d, want %d", rec.Code, http.StatusGone)
+	}
+
+	// The other link's still good, and a HEAD doesn't use it up.
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		rec = httptest.NewRecorder()
+		get(rec, method, links[1], nil)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%v on the second link got status %d, want %d", method, rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestResumeCountsOnce(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "big.iso")
+	if err := os.WriteFile(file, bytes.Repeat([]byte("data"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Downloads: 2, Total: -1, FilePath: file, FileName: "big.iso"}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	get := func(w http.ResponseWriter, remote, rng string) {
+		req := httptest.NewRequest(http.MethodGet, "/big.iso", nil)
+		req.RemoteAddr = remote
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		mux.ServeHTTP(w, req)
+	}
+
+	// The download drops, and drops again partway through picking it back up.
+	get(brokenWriter{httptest.NewRecorder()}, "192.0.2.1:1000", "")
+	get(brokenWriter{httptest.NewRecorder()}, "192.0.2.1:1001", "bytes=1000-")
+
+	rec := httptest.NewRecorder()
+	get(rec, "192.0.2.1:1002", "bytes=1000-")
+	if rec.Code != http.StatusPartialContent || rec.Body.Len() != 3000 {
+		t.Fatalf("resume got status %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	// All that was one download, so there's still one left for somebody else.
+	rec = httptest.NewRecorder()
+	get(rec, "192.0.2.2:1000", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second device got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// Once it's finished, there's nothing left to resume.
+	rec = httptest.NewRecorder()
+	get(rec, "192.0.2.1:1003", "bytes=1000-")
+	if rec.Code != http.StatusGone {
+		t.Errorf("resuming a finished download got status %d, want %d", rec.Code, http.StatusGone)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	inTempDir(t)
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Uploading: true, Uploads: -1, Progress: true}
+	mux := http.NewServeMux()
+	setupUpload(mux, &http.Server{}, conf, tpl)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// The stream's subscribed by the time the headers come back.
+	stream, err := http.Get(srv.URL + "/progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	if ct := stream.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got Content-Type %q", ct)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/notes.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The stream ends by itself once the upload's done.
+	events, err := io.ReadAll(stream.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "event: done\ndata: {\"id\":1,\"bytes\":5,\"total\":5,\"done\":true,\"ok\":true}\n\n"
+	if !strings.HasSuffix(string(events), want) {
+		t.Errorf("got events %q, want them to end with %q", events, want)
+	}
+}
+
+func TestCheckLAN(t *testing.T) {
+	addrs := func(ips ...string) []net.Addr {
+		var out []net.Addr
+		for _, ip := range ips {
+			addr, ipnet, err := net.ParseCIDR(ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, &net.IPNet{IP: addr, Mask: ipnet.Mask})
+		}
+		return out
+	}
+	home := addrs("127.0.0.1/8", "192.168.1.2/24", "::1/128", "fe80::1/64", "fd00::2/64")
+	vps := append(home, addrs("203.0.113.7/24")...)
+
+	tests := []struct {
+		bind  string
+		addrs []net.Addr
+		ok    bool
+	}{
+		{"", home, true},
+		{"", vps, false},
+		{"0.0.0.0", vps, false},
+		{"192.168.1.2", vps, true},
+		{"10.0.0.5", nil, true},
+		{"100.100.1.1", nil, true},
+		{"fd00::2", nil, true},
+		{"fe80::1", nil, true},
+		{"203.0.113.7", home, false},
+		{"2001:db8::1", nil, false},
+		{"100.128.0.1", nil, false},
+	}
+	for _, test := range tests {
+		err := checkLAN(test.bind, test.addrs)
+		if (err == nil) != test.ok {
+			t.Errorf("checkLAN(%q) = %v, want ok %v", test.bind, err, test.ok)
+		}
+	}
+}
+
+func TestUploadFormBranding(t *testing.T) {
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var page bytes.Buffer
+	conf := Config{Uploading: true, Title: "<b>Acme & Co</b>", Logo: "https://example.com/logo.png"}
+	if err := tpl.ExecuteTemplate(&page, "UploadForm", conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<title>&lt;b&gt;Acme &amp; Co&lt;/b&gt;</title>",
+		"<h1>&lt;b&gt;Acme &amp; Co&lt;/b&gt;</h1>",
+		`<img id="logo" src="https://example.com/logo.png"`,
+	} {
+		if !strings.Contains(page.String(), want) {
+			t.Errorf("upload form is missing %s", want)
+		}
+	}
+}
+
+func TestUploadFormPaste(t *testing.T) {
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var page bytes.Buffer
+	if err := tpl.ExecuteTemplate(&page, "UploadForm", Config{Uploading: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<div id="pastezone" contenteditable inputmode="none" hidden>`,
+		`document.addEventListener("paste"`,
+		`"pasted-" + stamp`,
+	} {
+		if !strings.Contains(page.String(), want) {
+			t.Errorf("upload form is missing %s", want)
+		}
+	}
+}
+
+func TestBanner(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "slides.pdf")
+	if err := os.WriteFile(file, []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	banner := "Files from <b>Alice</b>'s laptop, gone at 5pm"
+	want := `<p id="banner">Files from &lt;b&gt;Alice&lt;/b&gt;&#39;s laptop, gone at 5pm</p>`
+
+	var form bytes.Buffer
+	if err := tpl.ExecuteTemplate(&form, "UploadForm", Config{Uploading: true, Banner: banner}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(form.String(), want) {
+		t.Errorf("upload form is missing %s", want)
+	}
+
+	conf := Config{Downloads: 1, Total: -1, Landing: true, Banner: banner, FilePath: file, FileName: "slides.pdf"}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("landing page is missing %s", want)
+	}
+
+	// No banner, no empty box.
+	form.Reset()
+	if err := tpl.ExecuteTemplate(&form, "UploadForm", Config{Uploading: true}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(form.String(), `id="banner"`) {
+		t.Error("upload form has a banner without -banner")
+	}
+}
+
+func TestUploadFormField(t *testing.T) {
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for field, want := range map[string]string{"": "file", "attachment": "attachment"} {
+		var page bytes.Buffer
+		if err := tpl.ExecuteTemplate(&page, "UploadForm", Config{Uploading: true, Field: field}); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{`name="` + want + `"`, `data.append("` + want + `"`} {
+			if !strings.Contains(page.String(), s) {
+				t.Errorf("upload form with -field %q is missing %s", field, s)
+			}
+		}
+	}
+}
+
+func TestUploadReceipt(t *testing.T) {
+	inTempDir(t)
+
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Uploading: true, Uploads: -1, Multiple: true}
+	mux := http.NewServeMux()
+	setupUpload(mux, &http.Server{}, conf, tpl)
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, err := mw.CreateFormFile("file", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, "hello")
+	mw.Close()
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"*/*", "Upload successful!\nnotes.txt (5 B)\n"},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "<table>"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(form.Bytes()))
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Accept", test.accept)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), test.want) {
+			t.Errorf("Accept %v got %d %q, want %q", test.accept, rec.Code, rec.Body, test.want)
+		}
+	}
+}
+
+func TestMetaJSON(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Downloads: 2, Total: -1, FilePath: file, FileName: "hello.txt"}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+
+	meta := func() fileMeta {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/meta.json", nil))
+		var meta fileMeta
+		if err := json.NewDecoder(rec.Body).Decode(&meta); err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+
+	// Asking about the file mustn't use up a download.
+	for i := 0; i < 3; i++ {
+		if got := meta(); got.Remaining != 2 || got.Size != 5 || got.Name != "hello.txt" {
+			t.Fatalf("got %+v", got)
+		}
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hello.txt", nil))
+	if got := meta(); got.Remaining != 1 {
+		t.Errorf("got %d downloads remaining after one download, want 1", got.Remaining)
+	}
+}
+
+func TestStreamUpload(t *testing.T) {
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("note", "fields before the file are skipped")
+	fw, err := mw.CreateFormFile("file", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, "hello")
+	mw.Close()
+
+	post := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(form.Bytes()))
+	post.Header.Set("Content-Type", mw.FormDataContentType())
+	put := httptest.NewRequest(http.MethodPut, "/notes.txt", strings.NewReader("hello"))
+
+	for _, req := range []*http.Request{post, put} {
+		var out bytes.Buffer
+		saved, err := streamUpload(&out, req, "", nil)
+		if err != nil {
+			t.Fatalf("%v: %v", req.Method, err)
+		}
+		if out.String() != "hello" || saved.Name != "notes.txt" || saved.Size != 5 {
+			t.Errorf("%v got %q, %+v", req.Method, out.String(), saved)
+		}
+	}
+
+	// A file that isn't accepted never makes it out.
+	var out bytes.Buffer
+	req := httptest.NewRequest(http.MethodPut, "/notes.txt", strings.NewReader("hello"))
+	_, err = streamUpload(&out, req, "", []string{".jpg"})
+	if !errors.As(err, new(notAccepted)) || out.Len() != 0 {
+		t.Errorf("got %v and %q, want the file turned away", err, out.String())
+	}
+
+	// Nor does one sent in the wrong field.
+	out.Reset()
+	req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(form.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	_, err = streamUpload(&out, req, "upload", nil)
+	if err == nil || out.Len() != 0 {
+		t.Errorf("got %v and %q, want the file turned away", err, out.String())
+	}
+}
+
+func TestStalledDownloadDoesNotCount(t *testing.T) {
+	dir := inTempDir(t)
+	file := filepath.Join(dir, "big.bin")
+	// Big enough that it can't all fit in the socket buffers.
+	if err := os.WriteFile(file, make([]byte, 32<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Downloads: 1, Total: -1, FilePath: file, FileName: "big.bin"}
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	setupDownload(mux, &http.Server{}, conf, tpl)
+	srv := httptest.NewServer(detectStalls(100*time.Millisecond, mux))
+	defer srv.Close()
+
+	// Ask for the file and then never read it.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	io.WriteString(conn, "GET /big.bin HTTP/1.1\r\nHost: ruff\r\n\r\n")
+
+	// The download gets claimed, then handed back once it stalls.
+	claimed := false
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(20 * time.Millisecond) {
+		resp, err := http.Get(srv.URL + "/meta.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta fileMeta
+		json.NewDecoder(resp.Body).Decode(&meta)
+		resp.Body.Close()
+		if meta.Remaining == 0 {
+			claimed = true
+		}
+		if claimed && meta.Remaining == 1 {
+			return
+		}
+	}
+	t.Fatalf("stalled download wasn't handed back, claimed: %v", claimed)
+}
+
+func TestDedup(t *testing.T) {
+	dir := inTempDir(t)
+	dd := newDedup()
+
+	first, err := writeFile("photo.jpg", strings.NewReader("a lovely photo"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dd.check(&first); err != nil || first.Duplicate != "" {
+		t.Fatalf("got %+v, %v, want photo.jpg kept", first, err)
+	}
+
+	// Same size, different contents.
+	other, err := writeFile("other.jpg", strings.NewReader("a lovely phone"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dd.check(&other); err != nil || other.Duplicate != "" {
+		t.Fatalf("got %+v, %v, want other.jpg kept", other, err)
+	}
+
+	again, err := writeFile("photo (1).jpg", strings.NewReader("a lovely photo"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dd.check(&again); err != nil || again.Duplicate != "photo.jpg" {
+		t.Fatalf("got %+v, %v, want a duplicate of photo.jpg", again, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "photo (1).jpg")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the duplicate was kept: %v", err)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	got := make(chan transferEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event transferEvent
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got Content-Type %q", r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		got <- event
+	}))
+	defer hook.Close()
+
+	want := transferEvent{"download", "x.zip", "1.2.3.4", 123}
+	notify(hook.URL, want)
+	webhooks.Wait()
+	if event := <-got; event != want {
+		t.Errorf("got %+v, want %+v", event, want)
+	}
+
+	// Nobody listening is logged and shrugged off.
+	notify("http://127.0.0.1:1/", want)
+	webhooks.Wait()
+}
+
+func TestServeArchive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "photos")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "b.sh"), []byte("two"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := serveArchive(rec, httptest.NewRequest(http.MethodGet, "/photos.tar.gz", nil), dir); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	got := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		got[header.Name] = fmt.Sprintf("%o %s", header.Mode&0777, data)
+	}
+	want := map[string]string{
+		"photos/":         "755 ",
+		"photos/a.txt":    "644 one",
+		"photos/sub/":     "755 ",
+		"photos/sub/b.sh": "755 two",
+	}
+	for name, entry := range want {
+		if got[name] != entry {
+			t.Errorf("%v: got %q, want %q", name, got[name], entry)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestPrivileged(t *testing.T) {
+	denied := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", fs.ErrPermission)}
+	for _, c := range []struct {
+		conf Config
+		err  error
+		want bool
+	}{
+		{Config{Port: 80}, denied, true},
+		{Config{Port: 8008}, denied, false},
+		{Config{Port: 80, Unix: "ruff.sock"}, denied, false},
+		{Config{Port: 80}, errors.New("address already in use"), false},
+	} {
+		if got := privileged(c.conf, c.err); got != c.want {
+			t.Errorf("privileged(port %v, %v) = %v, want %v", c.conf.Port, c.err, got, c.want)
+		}
+	}
+}
+
+func TestCORSTusDiscovery(t *testing.T) {
+	tus := newTusServer(Config{MaxSize: 1 << 20}, func(name string) string { return name }, func(r *http.Request, saved *savedFile) error {
+		return nil
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/tus/", tus)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%v %v got past cors", r.Method, r.URL.Path)
+	})
+	handler := cors("/tus/", mux)
+
+	// tus clients ask the tus endpoint what it supports.
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/tus/", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	for header, want := range map[string]string{
+		"Tus-Version":                 tusVersion,
+		"Tus-Extension":               "creation",
+		"Tus-Max-Size":                "1048576",
+		"Access-Control-Allow-Origin": "*",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%v = %q, want %q", header, got, want)
+		}
+	}
+
+	// Everything else is still answered by cors itself.
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/", nil))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Tus-Version") != "" {
+		t.Errorf("got status %d and Tus-Version %q", rec.Code, rec.Header().Get("Tus-Version"))
+	}
+}
+
+func TestTus(t *testing.T) {
+	inTempDir(t)
+	var got *savedFile
+	tus := newTusServer(Config{}, func(name string) string { return name }, func(r *http.Request, saved *savedFile) error {
+		got = saved
+		return nil
+	})
+	send := func(method, path string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		tus.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send(http.MethodPost, "/tus/", nil, "Upload-Length", "13", "Upload-Metadata", "filename bm90ZXMudHh0")
+	loc := rec.Header().Get("Location")
+	if rec.Code != http.StatusCreated || !strings.HasPrefix(loc, "/tus/") {
+		t.Fatalf("create got status %d, Location %q", rec.Code, loc)
+	}
+
+	// The connection drops partway, and what made it through is kept.
+	rec = send(http.MethodPatch, loc, &failingReader{}, "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("interrupted patch got status %d", rec.Code)
+	}
+	rec = send(http.MethodHead, loc, nil)
+	if offset := rec.Header().Get("Upload-Offset"); offset != "9" {
+		t.Fatalf("got Upload-Offset %q after the interruption, want 9", offset)
+	}
+
+	// Picking up from the wrong place is refused.
+	rec = send(http.MethodPatch, loc, strings.NewReader("le"), "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("patch at the wrong offset got status %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	rec = send(http.MethodPatch, loc, strings.NewReader("le!!"), "Content-Type", "application/offset+octet-stream", "Upload-Offset", "9")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "13" {
+		t.Fatalf("final patch got status %d, Upload-Offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	data, err := os.ReadFile("notes.txt")
+	if err != nil || string(data) != "half a file!!" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if got == nil || got.Name != "notes.txt" || got.Size != 13 {
+		t.Errorf("upload was handed off as %+v", got)
+	}
+
+	// Once it's done, there's nothing left to resume.
+	if rec := send(http.MethodHead, loc, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("finished upload got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	dir := inTempDir(t)
+	tpl, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first bytes of a PNG are enough to tell what it is.
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	files := map[string][]byte{
+		"notes.txt": []byte("<b>hello</b>"),
+		"photo.png": png,
+		"huge.txt":  bytes.Repeat([]byte("a"), previewLimit+1),
+		"data.bin":  {0, 1, 2, 3},
+	}
+
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		conf := Config{Downloads: 1, Total: -1, Preview: true, FilePath: file, FileName: name}
+		mux := http.NewServeMux()
+		setupDownload(mux, &http.Server{}, conf, tpl)
+
+		for _, path := range []string{"/preview", "/preview?raw"} {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			body := rec.Body.String()
+			switch {
+			case path == "/preview" && name == "notes.txt" && !strings.Contains(body, "&lt;b&gt;hello&lt;/b&gt;</pre>"):
+				t.Errorf("%v: text wasn't shown escaped:\n%s", name, body)
+			case path == "/preview" && name == "photo.png" && !strings.Contains(body, `<img class="preview" src="?raw"`):
+				t.Errorf("%v: image wasn't embedded:\n%s", name, body)
+			case path == "/preview" && (name == "huge.txt" || name == "data.bin") && !strings.Contains(body, "can't be previewed"):
+				t.Errorf("%v: got a preview:\n%s", name, body)
+			case path == "/preview?raw" && name == "photo.png" && (rec.Code != http.StatusOK || body != string(png)):
+				t.Errorf("%v: raw image got status %d", name, rec.Code)
+			case path == "/preview?raw" && name != "photo.png" && rec.Code != http.StatusNotFound:
+				t.Errorf("%v: raw got status %d, want %d", name, rec.Code, http.StatusNotFound)
+			}
+		}
+
+		// None of that was a download.
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%v: download after previewing got status %d", name, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/grandcat/zeroconf"
+)
+
+// mdnsName is the hostname RUFF advertises itself under with -mdns.
+const mdnsName = "ruff.local"
+
+// advertise announces RUFF over multicast DNS as ruff.local pointing at ip,
+// so recipients on the LAN can use a name instead of typing out an address.
+// Call Shutdown on the returned server to unregister it.
+func advertise(ip string, port int) (*zeroconf.Server, error) {
+	return zeroconf.RegisterProxy("RUFF", "_http._tcp", "local.", port, "ruff", []string{ip}, []string{"path=/"}, nil)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Counters for -metrics. They're kept whether or not anybody's looking.
+var (
+	downloadsServed atomic.Int64
+	uploadsReceived atomic.Int64
+	bytesServed     atomic.Int64
+	bytesReceived   atomic.Int64
+	activeConns     atomic.Int64
+)
+
+// trackConns keeps activeConns up to date as the server's connections come
+// and go. It's meant for http.Server.ConnState.
+func trackConns(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		activeConns.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		activeConns.Add(-1)
+	}
+}
+
+// metrics serves the counters in the Prometheus text format.
+func metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"ruff_downloads_total", "counter", "Downloads served in full.", downloadsServed.Load()},
+		{"ruff_uploads_total", "counter", "Uploads received in full.", uploadsReceived.Load()},
+		{"ruff_sent_bytes_total", "counter", "Bytes sent in responses.", bytesServed.Load()},
+		{"ruff_received_bytes_total", "counter", "Bytes of uploaded files saved to disk.", bytesReceived.Load()},
+		{"ruff_active_connections", "gauge", "Connections currently open.", activeConns.Load()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// previewLimit is the biggest file -preview will show. Anything bigger is
+// better off downloaded.
+const previewLimit = 4 << 20
+
+// previewKind says how the file can be shown in the browser: "text",
+// "image", or "" if it can't be. It goes by the file's type, sniffing the
+// start of it if the extension doesn't say.
+func previewKind(conf Config) string {
+	ctype := fileType(conf)
+	if ctype == "" {
+		f, err := os.Open(conf.FilePath)
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		start := make([]byte, 512)
+		n, _ := io.ReadFull(f, start)
+		ctype = http.DetectContentType(start[:n])
+	}
+	ctype, _, _ = strings.Cut(ctype, ";")
+
+	switch {
+	// An SVG can carry scripts, so it's not shown from our origin.
+	case ctype == "image/svg+xml":
+		return ""
+	case strings.HasPrefix(ctype, "image/"):
+		return "image"
+	case strings.HasPrefix(ctype, "text/"), ctype == "application/json", ctype == "application/xml":
+		return "text"
+	}
+	return ""
+}
+
+// servePreview shows the file in a page of its own for -preview, so it can
+// be looked at without downloading it. Images are embedded from the same path
+// with ?raw. None of it counts as a download.
+func servePreview(w http.ResponseWriter, r *http.Request, conf Config, tpl *template.Template, link string) error {
+	info, err := os.Stat(conf.FilePath)
+	if err != nil {
+		return err
+	}
+	page := struct {
+		Name, Size, Link, Kind, Text string
+		TooBig                       bool
+	}{Name: conf.FileName, Size: humanSize(info.Size()), Link: link}
+	if info.Size() > previewLimit {
+		page.TooBig = true
+	} else {
+		page.Kind = previewKind(conf)
+	}
+
+	if _, raw := r.URL.Query()["raw"]; raw {
+		if page.Kind != "image" {
+			http.NotFound(w, r)
+			return nil
+		}
+		f, err := os.Open(conf.FilePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if ctype := fileType(conf); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Disposition", "inline")
+		http.ServeContent(w, r, conf.FileName, info.ModTime(), f)
+		return nil
+	}
+
+	if page.Kind == "text" {
+		data, err := os.ReadFile(conf.FilePath)
+		if err != nil {
+			return err
+		}
+		// Binary that only looks like text isn't worth showing.
+		if utf8.Valid(data) {
+			page.Text = string(data)
+		} else {
+			page.Kind = ""
+		}
+	}
+	return tpl.ExecuteTemplate(w, "Preview", page)
+}
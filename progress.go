@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// progressInterval is the most often an upload's progress goes out to
+// whoever's following /progress.
+const progressInterval = 250 * time.Millisecond
+
+// progress is one update on an upload. ID tells uploads apart when there's
+// more than one going at once, and Total is -1 if the client didn't say how
+// big the upload is.
+type progress struct {
+	ID    int   `json:"id"`
+	Bytes int64 `json:"bytes"`
+	Total int64 `json:"total"`
+	Done  bool  `json:"done"`
+	OK    bool  `json:"ok"`
+}
+
+// progressFeed passes updates on uploads along to everyone following
+// /progress.
+type progressFeed struct {
+	mu     sync.Mutex
+	nextID int
+	subs   map[chan progress]struct{}
+	closed chan struct{}
+}
+
+func newProgressFeed() *progressFeed {
+	return &progressFeed{
+		subs:   make(map[chan progress]struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (f *progressFeed) subscribe() chan progress {
+	ch := make(chan progress, 16)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch
+}
+
+func (f *progressFeed) unsubscribe(ch chan progress) {
+	f.mu.Lock()
+	delete(f.subs, ch)
+	f.mu.Unlock()
+}
+
+// publish sends p to every subscriber without waiting on any of them. If one
+// has fallen behind, its oldest update is dropped to make room, since each
+// update supersedes the last.
+func (f *progressFeed) publish(p progress) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- p:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- p
+		}
+	}
+}
+
+// close ends every stream, for when the server's shutting down.
+func (f *progressFeed) close() {
+	close(f.closed)
+}
+
+// track wraps an upload's body so reading it publishes how far it's got. The
+// returned function publishes that the upload's done, and whether it went
+// through.
+func (f *progressFeed) track(r *http.Request) func(ok bool) {
+	f.mu.Lock()
+	f.nextID++
+	id := f.nextID
+	f.mu.Unlock()
+
+	total := r.ContentLength
+	if total < 0 {
+		total = -1
+	}
+	body := &progressReader{ReadCloser: r.Body, feed: f, p: progress{ID: id, Total: total}}
+	r.Body = body
+	f.publish(body.p)
+	return func(ok bool) {
+		body.p.Done, body.p.OK = true, ok
+		f.publish(body.p)
+	}
+}
+
+// progressReader counts the bytes read from an upload, publishing the count
+// every progressInterval.
+type progressReader struct {
+	io.ReadCloser
+	feed *progressFeed
+	p    progress
+	last time.Time
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.p.Bytes += int64(n)
+	if now := time.Now(); now.Sub(r.last) >= progressInterval {
+		r.last = now
+		r.feed.publish(r.p)
+	}
+	return n, err
+}
+
+// serve streams updates as server-sent events until every upload it's heard
+// about is done, the client goes away, or the server shuts down. Each update
+// is a progress event, and the last one for each upload is a done event.
+func (f *progressFeed) serve(w http.ResponseWriter, r *http.Request) {
+	// The stream can go quiet for a long while between updates, so don't let
+	// a -stall-timeout deadline left on the connection by an earlier write cut
+	// it off. Each update that's written sets a fresh one, see detectStalls.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	ch := f.subscribe()
+	defer f.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	// Uploads the stream has heard about, and whether they're still going.
+	following := make(map[int]bool)
+	for {
+		select {
+		case p := <-ch:
+			event := "progress"
+			if p.Done {
+				event = "done"
+			}
+			data, err := json.Marshal(p)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+			following[p.ID] = !p.Done
+			finished := true
+			for _, going := range following {
+				finished = finished && !going
+			}
+			if finished {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-f.closed:
+			return
+		}
+	}
+}
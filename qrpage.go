@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// qrSVG draws a QR code for text as an SVG that scales cleanly to whatever
+// size it's printed at.
+func qrSVG(text string) (template.HTML, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+
+	// Leave the four module quiet zone scanners expect around the edge.
+	size := code.Size + 8
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path d="`, size, size)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+
+	// Everything in there came from us, not the client.
+	return template.HTML(b.String()), nil
+}
+
+// qrPage serves a printable card with the QR code, the URL, and the name of
+// whatever's being shared, for when nobody can see the terminal.
+func qrPage(tpl *template.Template, name, url string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svg, err := qrSVG(url)
+		if err != nil {
+			http.Error(w, "could not make a QR code", http.StatusInternalServerError)
+			return
+		}
+
+		card := struct {
+			Name, URL string
+			QR        template.HTML
+		}{name, url, svg}
+		err = tpl.ExecuteTemplate(w, "QRPage", card)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
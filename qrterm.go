@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/mdp/qrterminal"
+	"golang.org/x/term"
+	"rsc.io/qr"
+)
+
+// drawQR draws a QR code for text in the terminal. If the terminal's too
+// narrow for it, a clipped code that won't scan is no use to anyone, so it's
+// left out and ok is false, with need saying how many columns it takes.
+// Output that isn't going to a terminal gets the code regardless.
+func drawQR(w io.Writer, text string) (need int, ok bool) {
+	width := -1
+	if f, isFile := w.(*os.File); isFile && term.IsTerminal(int(f.Fd())) {
+		if cols, _, err := term.GetSize(int(f.Fd())); err == nil {
+			width = cols
+		}
+	}
+
+	level, need, ok := qrLevel(text, width)
+	if ok {
+		qrterminal.GenerateHalfBlock(text, level, w)
+	}
+	return need, ok
+}
+
+// qrLevel picks the error correction level for a QR code that has to fit in
+// width columns, or any width if it's -1. Medium is the usual, but low makes
+// for a smaller code if that's what it takes.
+func qrLevel(text string, width int) (level qr.Level, need int, ok bool) {
+	for _, level := range []qr.Level{qr.M, qr.L} {
+		need = qrWidth(text, level)
+		if width < 0 || need <= width {
+			return level, need, true
+		}
+	}
+	return qr.M, need, false
+}
+
+// qrWidth is how many columns qrterminal takes to draw a QR code for text,
+// quiet zone and all.
+func qrWidth(text string, level qr.Level) int {
+	code, err := qr.Encode(text, level)
+	if err != nil {
+		return 0
+	}
+	return code.Size + 2*qrterminal.QUIET_ZONE
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateForget is how long a device has to go quiet before its limiter is
+// thrown away. By then it's had long enough to refill completely, so
+// forgetting it changes nothing.
+const rateForget = 3 * time.Minute
+
+// limitRate wraps a handler so no device can make more than perMinute
+// requests a minute, for -rate. Anybody over that is told how long to wait.
+// Each device gets the whole minute's worth up front, so a page load's burst
+// of requests doesn't trip it.
+func limitRate(perMinute int, next http.Handler) http.Handler {
+	type visitor struct {
+		limiter *rate.Limiter
+		seen    time.Time
+	}
+	var mu sync.Mutex
+	visitors := make(map[string]*visitor)
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			mu.Lock()
+			for ip, v := range visitors {
+				if time.Since(v.seen) > rateForget {
+					delete(visitors, ip)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	every := rate.Every(time.Minute / time.Duration(perMinute))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		mu.Lock()
+		v, ok := visitors[ip]
+		if !ok {
+			v = &visitor{limiter: rate.NewLimiter(every, perMinute)}
+			visitors[ip] = v
+		}
+		v.seen = time.Now()
+		res := v.limiter.Reserve()
+		wait := res.Delay()
+		if wait > 0 {
+			// Turned away requests shouldn't push back the next one that's
+			// allowed through.
+			res.Cancel()
+		}
+		mu.Unlock()
+
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests, slow down", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
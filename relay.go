@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// relayHeaderTimeout is as long as the upstream server gets to start
+// answering before a relayed download is given up on.
+const relayHeaderTimeout = 30 * time.Second
+
+// relayClient fetches the file from upstream. There's no overall timeout,
+// since a big file can take as long as it takes, but an upstream that never
+// answers doesn't get to hold a download hostage.
+var relayClient = &http.Client{
+	Transport: func() http.RoundTripper {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ResponseHeaderTimeout = relayHeaderTimeout
+		return t
+	}(),
+}
+
+// isRelay reports whether the file to send is an http(s) URL to pass along,
+// rather than a file on disk.
+func isRelay(filePath string) bool {
+	u, err := url.Parse(filePath)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// serveRelay fetches the file from upstream and passes it along as it
+// arrives, for when the file's somewhere only this machine can reach. It's
+// fetched fresh for every download, with the upstream's type and size passed
+// along. There are no ranges, every download gets the whole thing.
+//
+// Once the file's started going out, there's no taking back the 200. If the
+// upstream gives out partway, a client that was told the size can tell it came
+// up short, but one that wasn't can't.
+func serveRelay(w http.ResponseWriter, r *http.Request, conf Config) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, conf.FilePath, nil)
+	if err != nil {
+		http.Error(w, "could not fetch the file", http.StatusBadGateway)
+		return fmt.Errorf("could not fetch %v: %w", conf.FilePath, err)
+	}
+	resp, err := relayClient.Do(req)
+	if err != nil {
+		http.Error(w, "could not fetch the file", http.StatusBadGateway)
+		return fmt.Errorf("could not fetch %v: %w", conf.FilePath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "could not fetch the file", http.StatusBadGateway)
+		return fmt.Errorf("could not fetch %v: upstream answered %v", conf.FilePath, resp.Status)
+	}
+
+	// -content-type still gets the last word.
+	if ctype := resp.Header.Get("Content-Type"); ctype != "" && conf.ContentType == "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	// An upstream that stops sending is treated like a client that stops
+	// reading, see -stall-timeout.
+	var body io.Reader = resp.Body
+	if conf.Stall > 0 {
+		idle := time.AfterFunc(conf.Stall, cancel)
+		defer idle.Stop()
+		body = &idleReader{resp.Body, idle, conf.Stall}
+	}
+	_, err = io.Copy(w, body)
+	if err != nil {
+		return fmt.Errorf("could not relay %v: %w", conf.FilePath, err)
+	}
+	return nil
+}
+
+// idleReader pushes a timer back every time something's read, so it only
+// goes off when reading stalls.
+type idleReader struct {
+	r     io.Reader
+	timer *time.Timer
+	d     time.Duration
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.timer.Reset(r.d)
+	return n, err
+}
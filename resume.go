@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// resumeWindow is how long a device has to pick an interrupted download back
+// up before resuming it counts as a new one.
+const resumeWindow = 10 * time.Minute
+
+// resumes keeps track of downloads that were counted but got cut off partway.
+// When the device comes back with a range request for the rest of the same
+// file, it carries on without using up another download, until it's got to
+// the end.
+//
+// Downloads are told apart by device and ETag, so if the file's changed in
+// the meantime, there's nothing to resume.
+//
+// It's not safe for concurrent use, the download handler guards it.
+type resumes map[string]time.Time
+
+func resumeKey(ip, etag string) string {
+	return ip + " " + etag
+}
+
+// pending reports whether ip has an interrupted download of the file to
+// pick up.
+func (rs resumes) pending(ip, etag string, now time.Time) bool {
+	expires, ok := rs[resumeKey(ip, etag)]
+	return ok && now.Before(expires)
+}
+
+// interrupted marks a download as cut off, giving the device resumeWindow to
+// come back for the rest. Any that have run out are forgotten along the way.
+func (rs resumes) interrupted(ip, etag string, now time.Time) {
+	for key, expires := range rs {
+		if !now.Before(expires) {
+			delete(rs, key)
+		}
+	}
+	rs[resumeKey(ip, etag)] = now.Add(resumeWindow)
+}
+
+// finished forgets a download that's made it to the end.
+func (rs resumes) finished(ip, etag string) {
+	delete(rs, resumeKey(ip, etag))
+}
+
+// idleIn is how long until ip's download can no longer be resumed, or 0 if
+// it can't be already.
+func (rs resumes) idleIn(ip, etag string, now time.Time) time.Duration {
+	expires, ok := rs[resumeKey(ip, etag)]
+	if !ok {
+		return 0
+	}
+	return max(expires.Sub(now), 0)
+}
+
+// fileETag identifies a version of the file, for ETag and If-Range.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// reachesEnd reports whether a response sent the file through to its last
+// byte, going by its status and Content-Range.
+func reachesEnd(status int, h http.Header) bool {
+	if status == http.StatusOK {
+		return true
+	}
+	var start, end, size int64
+	_, err := fmt.Sscanf(h.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+	return status == http.StatusPartialContent && err == nil && end == size-1
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+)
+
+// fastBuffer is how big -fast makes the socket buffers, enough to keep a
+// gigabit link busy with a few milliseconds of latency.
+const fastBuffer = 4 << 20
+
+// maxBuffer is the most -read-buffer and -write-buffer can ask for. The OS
+// will cap them lower than this anyway.
+const maxBuffer = 1 << 30
+
+// tunedListener sets the socket buffer sizes for -read-buffer and
+// -write-buffer on each connection as it's accepted. 0 leaves the OS to pick.
+type tunedListener struct {
+	net.Listener
+	read, write int
+}
+
+// bufferedConn is the part of *net.TCPConn and *net.UnixConn that's needed
+// to size their buffers.
+type bufferedConn interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	sock, ok := conn.(bufferedConn)
+	if !ok {
+		return conn, nil
+	}
+
+	// A connection with the OS's buffers is still a working connection, so
+	// it's only worth a warning if they can't be changed.
+	if l.read > 0 {
+		if err := sock.SetReadBuffer(l.read); err != nil {
+			logger.Warn("could not set read buffer", "remote", conn.RemoteAddr().String(), "err", err)
+		}
+	}
+	if l.write > 0 {
+		if err := sock.SetWriteBuffer(l.write); err != nil {
+			logger.Warn("could not set write buffer", "remote", conn.RemoteAddr().String(), "err", err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// detectStalls wraps a handler so a transfer that makes no progress for d is
+// cut off, instead of a dead client hanging on to it forever. Every read of
+// the request body and write of the response pushes the deadline back, so a
+// big file can take as long as it likes as long as it keeps moving.
+func detectStalls(d time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		r.Body = &stallReader{ReadCloser: r.Body, rc: rc, d: d}
+		next.ServeHTTP(&stallWriter{ResponseWriter: w, rc: rc, d: d}, r)
+	})
+}
+
+// stallWriter pushes the write deadline back before each write. It leaves
+// out ReadFrom on purpose: sendfile hands the whole file to the kernel in one
+// go, and there'd be no telling a stalled transfer from a long one.
+type stallWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+	d  time.Duration
+}
+
+func (w *stallWriter) Write(b []byte) (int, error) {
+	w.rc.SetWriteDeadline(time.Now().Add(w.d))
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *stallWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// stallReader pushes the read deadline back before each read.
+type stallReader struct {
+	io.ReadCloser
+	rc *http.ResponseController
+	d  time.Duration
+}
+
+func (r *stallReader) Read(b []byte) (int, error) {
+	r.rc.SetReadDeadline(time.Now().Add(r.d))
+	return r.ReadCloser.Read(b)
+}
+
+// stalled reports whether err is down to a transfer stalling.
+func stalled(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
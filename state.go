@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// savedState is what -state keeps on disk between runs.
+type savedState struct {
+	Remaining int `json:"remaining"`
+}
+
+// loadState reads the number of downloads left from a -state file. ok is
+// false if there's no file yet, meaning this is the first run.
+func loadState(name string) (remaining int, ok bool, err error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("could not read state: %w", err)
+	}
+
+	var state savedState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return 0, false, fmt.Errorf("could not read state from %v: %w", name, err)
+	}
+	return state.Remaining, true, nil
+}
+
+// saveState writes the number of downloads left to a -state file. It goes to
+// a temporary file first and gets renamed over the old one, so a crash
+// halfway through can't leave a mangled count behind.
+func saveState(name string, remaining int) error {
+	data, err := json.Marshal(savedState{Remaining: remaining})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".ruff-state-*")
+	if err != nil {
+		return fmt.Errorf("could not save state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not save state: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		return fmt.Errorf("could not save state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// notAccepted is what streamUpload returns for a file -accept turns away.
+type notAccepted struct {
+	name   string
+	accept []string
+}
+
+func (e notAccepted) Error() string {
+	return fmt.Sprintf("files of type %q are not accepted, allowed types are: %v", filepath.Ext(e.name), strings.Join(e.accept, " "))
+}
+
+// streamUpload copies the one file in an upload to dst as it comes in, for
+// -to-stdout. A PUT body is taken as-is, and a form's first file is read
+// straight off the wire, so nothing's buffered to disk along the way. With
+// field set, a file in any other field is refused. Nothing's written to dst
+// unless the file gets past -accept.
+func streamUpload(dst io.Writer, r *http.Request, field string, accept []string) (savedFile, error) {
+	var name string
+	var body io.Reader
+	if r.Method == http.MethodPut {
+		// Nothing's saved under the name, so it can be as long as it likes.
+		name, body = rawName(r.URL.Path, 0), r.Body
+	} else {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return savedFile{}, fmt.Errorf("could not read upload: %w", err)
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return savedFile{}, errors.New("no file found in the upload")
+			}
+			if err != nil {
+				return savedFile{}, fmt.Errorf("could not read upload: %w", err)
+			}
+			if part.FileName() != "" {
+				if field != "" && part.FormName() != field {
+					return savedFile{}, fmt.Errorf("files are only accepted in the %q field, not %q", field, part.FormName())
+				}
+				name, body = rawName(part.FileName(), 0), part
+				break
+			}
+		}
+	}
+
+	if name == "" {
+		return savedFile{}, errors.New("no file name provided")
+	}
+	if !accepted(accept, name) {
+		return savedFile{Name: name}, notAccepted{name, accept}
+	}
+
+	saved := savedFile{Name: name}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), body)
+	saved.Size = n
+	if err != nil {
+		return saved, fmt.Errorf("could not copy upload to stdout: %w", err)
+	}
+	saved.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return saved, nil
+}
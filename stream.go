@@ -0,0 +1,58 @@
+package main
+
+import "time"
+
+// streamWindow is how long a device can go quiet between range requests and
+// still be counted as watching the same stream.
+const streamWindow = 30 * time.Second
+
+// streams keeps track of devices streaming the file. A media player makes a
+// flurry of range requests as it buffers and seeks, and it'd be a shame for
+// -count 1 to run out a second into a video, so once a device has had a
+// download counted, any range requests it makes within streamWindow of its
+// last one ride along for free.
+//
+// It's not safe for concurrent use, the download handler guards it.
+type streams map[string]*stream
+
+type stream struct {
+	last   time.Time
+	active int
+}
+
+// watching reports whether ip has a stream going.
+func (s streams) watching(ip string, now time.Time) bool {
+	st, ok := s[ip]
+	return ok && (st.active > 0 || now.Sub(st.last) < streamWindow)
+}
+
+// begin marks a range request from a device that's already watching.
+func (s streams) begin(ip string) {
+	s[ip].active++
+}
+
+// end marks a range request as finished, starting a stream if it's the first
+// one to be counted.
+func (s streams) end(ip string, now time.Time, counted bool) {
+	st, ok := s[ip]
+	if !ok {
+		st = &stream{}
+		s[ip] = st
+	}
+	if !counted {
+		st.active--
+	}
+	st.last = now
+}
+
+// idleIn is how long until ip's stream could be over, or 0 if it already is.
+func (s streams) idleIn(ip string, now time.Time) time.Duration {
+	st, ok := s[ip]
+	if !ok {
+		return 0
+	}
+	if st.active > 0 {
+		return streamWindow
+	}
+	return max(streamWindow-now.Sub(st.last), 0)
+}
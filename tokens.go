@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// linkState is how far along a -tokens link is. A link's in use while a
+// download's going, and only used once one's made it all the way through, so
+// a download that gets cut off leaves the link good for another try.
+type linkState int
+
+const (
+	linkFree linkState = iota
+	linkInUse
+	linkUsed
+)
+
+// makeTokens makes n random tokens for -tokens, one per link.
+func makeTokens(n int) ([]string, error) {
+	tokens := make([]string, n)
+	for i := range tokens {
+		token := make([]byte, 8)
+		_, err := rand.Read(token)
+		if err != nil {
+			return nil, fmt.Errorf("could not make a one-time link: %w", err)
+		}
+		tokens[i] = hex.EncodeToString(token)
+	}
+	return tokens, nil
+}
+
+// linkPaths are the paths the file's served at with -tokens, one for each
+// token.
+func (c Config) linkPaths() []string {
+	paths := make([]string, len(c.Tokens))
+	for i, token := range c.Tokens {
+		paths[i] = "/" + token + c.sharePath()
+	}
+	return paths
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tusVersion is the only version of the tus protocol spoken here.
+const tusVersion = "1.0.0"
+
+// tusServer takes resumable uploads over the tus protocol, for -tus. Only
+// the core protocol and the creation extension are supported: a POST makes a
+// new upload, HEAD says how much of it has arrived, and PATCH adds to it,
+// picking up wherever the last one left off.
+//
+// Uploads in progress only live as long as RUFF does. Their .part files are
+// cleaned up when it shuts down, since there'd be nobody left to finish them.
+type tusServer struct {
+	maxSize byteSize
+	maxName int
+	accept  []string
+	// path is where uploads are found, for the Location of new ones.
+	path string
+	// dated says where a file is saved, given the name it was sent with.
+	dated func(name string) string
+	// complete is handed each upload once it's all arrived.
+	complete func(r *http.Request, saved *savedFile) error
+	// full, if set, says no more uploads are being taken, for -verify.
+	full func() bool
+
+	mu      sync.Mutex
+	uploads map[string]*tusUpload
+	closed  bool
+}
+
+// tusUpload is one upload in progress.
+type tusUpload struct {
+	name   string
+	length int64
+	offset int64
+	part   *os.File
+	hash   hash.Hash
+	// busy is set while a PATCH is adding to the upload, so two can't write
+	// at once.
+	busy bool
+}
+
+func newTusServer(conf Config, dated func(string) string, complete func(*http.Request, *savedFile) error) *tusServer {
+	return &tusServer{
+		maxSize:  conf.MaxSize,
+		maxName:  conf.MaxNameLength,
+		accept:   conf.Accept,
+		path:     conf.UploadPath() + "tus/",
+		dated:    dated,
+		complete: complete,
+		uploads:  make(map[string]*tusUpload),
+	}
+}
+
+func (t *tusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation")
+		if t.maxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(int64(t.maxSize), 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "only tus "+tusVersion+" is supported", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/tus/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		t.create(w, r)
+	case id != "" && r.Method == http.MethodHead:
+		t.head(w, r, id)
+	case id != "" && r.Method == http.MethodPatch:
+		t.patch(w, r, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// create starts a new upload, answering with where to send it.
+func (t *tusServer) create(w http.ResponseWriter, r *http.Request) {
+	if t.full != nil && t.full() {
+		http.Error(w, "all the uploads are in, there's no room for another", http.StatusGone)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is missing or invalid", http.StatusBadRequest)
+		return
+	}
+	if t.maxSize > 0 && length > int64(t.maxSize) {
+		http.Error(w, fmt.Sprintf("upload is too large, the limit is %v", &t.maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	name := rawName(tusMetadata(r.Header.Get("Upload-Metadata"), "filename"), t.maxName)
+	if name == "" {
+		http.Error(w, "no file name provided, set filename in Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	if !accepted(t.accept, name) {
+		http.Error(w, notAccepted{name, t.accept}.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	name = t.dated(name)
+	part, err := createPart(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		http.Error(w, "could not start upload", http.StatusInternalServerError)
+		return
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		part.Close()
+		os.Remove(part.Name())
+		fmt.Fprintln(os.Stderr, err)
+		http.Error(w, "could not start upload", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(token)
+	upload := &tusUpload{name: name, length: length, part: part, hash: sha256.New()}
+
+	// Nothing to wait for with an empty file.
+	if length == 0 {
+		if err := t.finish(r, upload); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			http.Error(w, "could not save upload", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		t.mu.Lock()
+		t.uploads[id] = upload
+		t.mu.Unlock()
+	}
+
+	logger.Info("upload started", "name", name, "bytes", length, "id", id)
+	w.Header().Set("Location", t.path+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// head says how much of an upload has arrived.
+func (t *tusServer) head(w http.ResponseWriter, r *http.Request, id string) {
+	t.mu.Lock()
+	upload, ok := t.uploads[id]
+	var offset, length int64
+	if ok {
+		offset, length = upload.offset, upload.length
+	}
+	t.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// patch adds to an upload, starting from where the client thinks it left
+// off. Whatever makes it through is kept even if the connection drops, so the
+// client can carry on from there.
+func (t *tusServer) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type has to be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset is missing or invalid", http.StatusBadRequest)
+		return
+	}
+
+	t.mu.Lock()
+	upload, ok := t.uploads[id]
+	if !ok {
+		t.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	if upload.busy || upload.offset != offset {
+		t.mu.Unlock()
+		http.Error(w, "Upload-Offset doesn't match what's been received", http.StatusConflict)
+		return
+	}
+	upload.busy = true
+	t.mu.Unlock()
+
+	// Anything past the length the upload was created with is ignored.
+	n, err := io.Copy(io.MultiWriter(upload.part, upload.hash), io.LimitReader(r.Body, upload.length-offset))
+
+	t.mu.Lock()
+	upload.offset += n
+	upload.busy = false
+	complete := upload.offset == upload.length
+	// If RUFF's shutting down, an upload that isn't done never will be.
+	abandoned := t.closed && !complete
+	if complete || abandoned {
+		delete(t.uploads, id)
+	}
+	t.mu.Unlock()
+	if abandoned {
+		upload.part.Close()
+		os.Remove(upload.part.Name())
+	}
+
+	if err != nil {
+		logger.Info("upload interrupted", "name", upload.name, "bytes", upload.offset, "id", id)
+		http.Error(w, "upload interrupted, resume from Upload-Offset", http.StatusInternalServerError)
+		return
+	}
+	if complete {
+		if err := t.finish(r, upload); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			http.Error(w, "could not save upload", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish gives a completed upload its real name and hands it off.
+func (t *tusServer) finish(r *http.Request, upload *tusUpload) error {
+	partName := upload.part.Name()
+	err := upload.part.Chmod(0644)
+	if err == nil {
+		err = upload.part.Close()
+	} else {
+		upload.part.Close()
+	}
+	name := upload.name
+	if err == nil {
+		name, err = claimName(partName, upload.name, "")
+	}
+	if err != nil {
+		os.Remove(partName)
+		return fmt.Errorf("could not save uploaded file: %w", err)
+	}
+
+	saved := savedFile{Name: name, Size: upload.length, SHA256: hex.EncodeToString(upload.hash.Sum(nil))}
+	bytesReceived.Add(saved.Size)
+	logger.Info("upload saved", "name", saved.Name, "bytes", saved.Size, "sha256", saved.SHA256)
+	return t.complete(r, &saved)
+}
+
+// close throws away every upload that isn't going anywhere. Any still being
+// added to get the chance to finish, and clean up after themselves if they
+// don't.
+func (t *tusServer) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for id, upload := range t.uploads {
+		if upload.busy {
+			continue
+		}
+		upload.part.Close()
+		os.Remove(upload.part.Name())
+		delete(t.uploads, id)
+	}
+}
+
+// tusMetadata picks a value out of an Upload-Metadata header, which is a
+// comma-separated list of keys each followed by a base64 encoded value.
+func tusMetadata(header, key string) string {
+	for _, pair := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k != key {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return ""
+		}
+		return string(value)
+	}
+	return ""
+}
+
+// createPart makes the .part file an upload is written to until it's all
+// there, next to where it'll end up.
+func createPart(name string) (*os.File, error) {
+	err := checkSymlinks(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir := filepath.Dir(name); dir != "." {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("could not create directory for uploaded file: %w", err)
+		}
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.part")
+	if err != nil {
+		return nil, fmt.Errorf("could not save uploaded file: %w", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway2"
+)
+
+// upnpLease is how long the router keeps a port mapping before it needs
+// renewing.
+const upnpLease = 10 * time.Minute
+
+// routerClient is the bit of an internet gateway's UPnP interface we need.
+// WANIPConnection1/2 and WANPPPConnection1 all provide it.
+type routerClient interface {
+	AddPortMapping(NewRemoteHost string, NewExternalPort uint16, NewProtocol string, NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32) error
+	DeletePortMapping(NewRemoteHost string, NewExternalPort uint16, NewProtocol string) error
+	GetExternalIPAddress() (string, error)
+}
+
+// findRouter looks around the LAN for an internet gateway that speaks UPnP.
+func findRouter() (routerClient, error) {
+	ip2, _, err := internetgateway2.NewWANIPConnection2Clients()
+	if err == nil && len(ip2) > 0 {
+		return ip2[0], nil
+	}
+	ip1, _, err := internetgateway2.NewWANIPConnection1Clients()
+	if err == nil && len(ip1) > 0 {
+		return ip1[0], nil
+	}
+	ppp1, _, err := internetgateway2.NewWANPPPConnection1Clients()
+	if err == nil && len(ppp1) > 0 {
+		return ppp1[0], nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("no UPnP internet gateway found: %w", err)
+	}
+	return nil, errors.New("no UPnP internet gateway found")
+}
+
+// mapPort asks the router to forward port from the outside world to the same
+// port on ip, returning our external address and a function to remove the
+// mapping again.
+func mapPort(ip string, port int) (string, func(), error) {
+	router, err := findRouter()
+	if err != nil {
+		return "", nil, err
+	}
+
+	external, err := router.GetExternalIPAddress()
+	if err != nil {
+		return "", nil, fmt.Errorf("could not get external address from router: %w", err)
+	}
+
+	// Lease the mapping rather than asking for it forever, so if we crash or
+	// get killed before unmapping, the router cleans up after us on its own.
+	// While we're running, renew it well before it runs out.
+	addMapping := func() error {
+		return router.AddPortMapping("", uint16(port), "TCP", uint16(port), ip, true, "RUFF", uint32(upnpLease/time.Second))
+	}
+	err = addMapping()
+	if err != nil {
+		return "", nil, fmt.Errorf("router refused to map port %v: %w", port, err)
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(upnpLease / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := addMapping()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "warning: could not renew port mapping: %v\n", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	unmap := func() {
+		close(stop)
+		err := router.DeletePortMapping("", uint16(port), "TCP")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: could not remove port mapping: %v\n", err)
+		}
+	}
+	return external, unmap, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// webhookTimeout is as long as a -webhook request gets before it's given up
+// on.
+const webhookTimeout = 5 * time.Second
+
+// webhooks lets shutdown wait for notifications that are still being sent,
+// so the last transfer's doesn't get lost when RUFF exits.
+var webhooks sync.WaitGroup
+
+// transferEvent is what -webhook gets told about each finished transfer.
+type transferEvent struct {
+	Event  string `json:"event"`
+	File   string `json:"file"`
+	Remote string `json:"remote"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// notify posts an event to the -webhook URL in the background. It's best
+// effort: a failure is logged and otherwise ignored.
+func notify(url string, event transferEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not send webhook: %v\n", err)
+		return
+	}
+
+	webhooks.Add(1)
+	go func() {
+		defer webhooks.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			logger.Error("webhook failed", "url", url, "err", err)
+			fmt.Fprintf(os.Stderr, "could not send webhook: %v\n", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			logger.Error("webhook failed", "url", url, "err", err)
+			fmt.Fprintf(os.Stderr, "could not send webhook: %v\n", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			logger.Error("webhook failed", "url", url, "status", resp.StatusCode)
+			fmt.Fprintf(os.Stderr, "webhook answered %v\n", resp.Status)
+		}
+	}()
+}
+
+// waitWebhooks waits for notifications still being sent, or for ctx to run
+// out.
+func waitWebhooks(ctx context.Context) {
+	finished := make(chan struct{})
+	go func() {
+		webhooks.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+}